@@ -0,0 +1,205 @@
+package libbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/rw"
+)
+
+const (
+	// AssetSourceWorkingPath is an asset in the working path, downloaded or copied by the app.
+	AssetSourceWorkingPath = "working"
+	// AssetSourceBundled is an asset read with the AssetReader of SetupV2Ray.
+	AssetSourceBundled = "bundled"
+)
+
+type AssetInfo struct {
+	Name   string
+	Source string
+	// URL is the download URL of assets updated by AssetManager.
+	URL          string
+	Size         int64
+	SHA256       string
+	ModifiedTime int64
+}
+
+// AssetManager updates geodata files in the working path, which SetupV2Ray
+// prefers over the bundled ones from the next start of the service.
+type AssetManager struct {
+	client HTTPClient
+	access sync.Mutex
+	assets map[string]*assetSource
+}
+
+type assetSource struct {
+	url       string
+	sha256URL string
+}
+
+func NewAssetManager(client HTTPClient) *AssetManager {
+	manager := &AssetManager{
+		client: client,
+		assets: make(map[string]*assetSource),
+	}
+	manager.SetAsset("geoip.dat", "https://github.com/v2fly/geoip/releases/latest/download/geoip.dat", "")
+	manager.SetAsset("geosite.dat", "https://github.com/v2fly/domain-list-community/releases/latest/download/dlc.dat", "")
+	return manager
+}
+
+// SetAsset sets the download URL of an asset, and the URL of its SHA256 sum file
+// in sha256sum format, which is the asset URL with a `.sha256sum` suffix if empty.
+func (m *AssetManager) SetAsset(name string, url string, sha256URL string) {
+	if sha256URL == "" {
+		sha256URL = url + ".sha256sum"
+	}
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.assets[name] = &assetSource{url, sha256URL}
+}
+
+// Update downloads the asset if its SHA256 sum has changed, verifies it and
+// replaces the file in the working path. It returns false if already up to date.
+func (m *AssetManager) Update(name string, handler HTTPProgressHandler) (bool, error) {
+	m.access.Lock()
+	source := m.assets[name]
+	m.access.Unlock()
+	if source == nil {
+		return false, E.New("unknown asset: ", name)
+	}
+	expectedSum, err := m.fetchSHA256(source.sha256URL)
+	if err != nil {
+		return false, E.Cause(err, "fetch sha256 sum of ", name)
+	}
+	assetPath := filepath.Join(sWorkingPath, name)
+	if currentSum, err := fileSHA256(assetPath); err == nil && currentSum == expectedSum {
+		return false, nil
+	}
+	request := m.client.NewRequest()
+	err = request.SetURL(source.url)
+	if err != nil {
+		return false, err
+	}
+	downloadPath := assetPath + ".download"
+	err = request.Download(downloadPath, handler)
+	if err != nil {
+		return false, E.Cause(err, "download ", name)
+	}
+	downloadSum, err := fileSHA256(downloadPath)
+	if err != nil {
+		os.Remove(downloadPath)
+		return false, err
+	}
+	if downloadSum != expectedSum {
+		os.Remove(downloadPath)
+		return false, E.New("sha256 mismatch of ", name, ": expected ", expectedSum, ", got ", downloadSum)
+	}
+	err = os.WriteFile(assetSourcePath(assetPath), []byte(source.url), 0o644)
+	if err != nil {
+		os.Remove(downloadPath)
+		return false, err
+	}
+	// rename in the same directory, so that readers see either the old or the new file
+	err = os.Rename(downloadPath, assetPath)
+	if err != nil {
+		os.Remove(downloadPath)
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *AssetManager) fetchSHA256(link string) (string, error) {
+	request := m.client.NewRequest()
+	err := request.SetURL(link)
+	if err != nil {
+		return "", err
+	}
+	response, err := request.Execute()
+	if err != nil {
+		return "", err
+	}
+	content, err := response.GetContent()
+	if err != nil {
+		return "", err
+	}
+	// `<sum>  <file name>`
+	fields := strings.Fields(content.Value)
+	if len(fields) == 0 {
+		return "", E.New("empty sha256 sum")
+	}
+	sum := strings.ToLower(fields[0])
+	if sumBytes, err := hex.DecodeString(sum); err != nil || len(sumBytes) != sha256.Size {
+		return "", E.New("invalid sha256 sum: ", fields[0])
+	}
+	return sum, nil
+}
+
+// Info returns the asset in use, the one in the working path if any, or the bundled one.
+func (m *AssetManager) Info(name string) (*AssetInfo, error) {
+	assetPath := filepath.Join(sWorkingPath, name)
+	if rw.IsFile(assetPath) {
+		fileInfo, err := os.Stat(assetPath)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := fileSHA256(assetPath)
+		if err != nil {
+			return nil, err
+		}
+		url, _ := os.ReadFile(assetSourcePath(assetPath))
+		return &AssetInfo{
+			Name:         name,
+			Source:       AssetSourceWorkingPath,
+			URL:          string(url),
+			Size:         fileInfo.Size(),
+			SHA256:       sum,
+			ModifiedTime: fileInfo.ModTime().UnixMilli(),
+		}, nil
+	}
+	content, err := readBundledAsset(name)
+	if err != nil {
+		return nil, E.Cause(err, "read bundled asset ", name)
+	}
+	sum := sha256.Sum256(content)
+	return &AssetInfo{
+		Name:   name,
+		Source: AssetSourceBundled,
+		Size:   int64(len(content)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// Reset removes the asset from the working path, falling back to the bundled one.
+func (m *AssetManager) Reset(name string) error {
+	assetPath := filepath.Join(sWorkingPath, name)
+	os.Remove(assetSourcePath(assetPath))
+	err := os.Remove(assetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func assetSourcePath(assetPath string) string {
+	return assetPath + ".source"
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = bufio.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -14,7 +14,10 @@ const (
 	// CommandSetClashMode
 	CommandGetSystemProxyStatus
 	CommandSetSystemProxyEnabled
-	// CommandConnections
+	CommandNetworkEvent
+	CommandExplainRoute
+	CommandConnections
 	// CommandCloseConnection
 	// CommandGetDeprecatedNotes
+	CommandNotifySubscriptionUpdateFailed
 )
@@ -27,6 +27,7 @@ type CommandClientHandler interface {
 	ClearLogs()
 	WriteLogs(messageList StringIterator)
 	WriteStatus(message *StatusMessage)
+	WriteNetworkEvent(event *NetworkEvent)
 	// WriteGroups(message OutboundGroupIterator)
 	// InitializeClashMode(modeList StringIterator, currentMode string)
 	// UpdateClashMode(newMode string)
@@ -96,6 +97,9 @@ func (c *CommandClient) Connect() error {
 		}
 		c.handler.Connected()
 		go c.handleStatusConn(conn)
+	case CommandNetworkEvent:
+		c.handler.Connected()
+		go c.handleNetworkEventConn(conn)
 		// case CommandGroup:
 		//	err = binary.Write(conn, binary.BigEndian, c.options.StatusInterval)
 		//	if err != nil {
@@ -0,0 +1,136 @@
+package libbox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/nekohasekai/libwtf/internal/conntrack"
+
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/varbin"
+)
+
+type Connection struct {
+	Network     string
+	Source      string
+	Destination string
+	InboundTag  string
+	// Owner is the package name, or the UID if the package is unknown, of the app that opened
+	// the connection. It is empty if FindProcess is disabled or the owner is not found.
+	Owner     string
+	OwnerUID  int32
+	CreatedAt int64
+}
+
+type ConnectionIterator interface {
+	Next() *Connection
+	HasNext() bool
+}
+
+// trackedConnection is a TUN session tracked by conntrack with the metadata shown to clients.
+type trackedConnection struct {
+	io.Closer
+	connection Connection
+}
+
+func newTrackedConnection(closer io.Closer, network string, source M.Socksaddr, destination M.Socksaddr, inboundTag string, owner *connectionOwner) *trackedConnection {
+	connection := Connection{
+		Network:     network,
+		Source:      source.String(),
+		Destination: destination.String(),
+		InboundTag:  inboundTag,
+		CreatedAt:   time.Now().UnixMilli(),
+	}
+	if owner != nil {
+		connection.Owner = owner.String()
+		connection.OwnerUID = owner.UID
+	}
+	return &trackedConnection{closer, connection}
+}
+
+// ListConnections lists the TUN sessions of the running service, which are only tracked
+// if the library is built with the `with_conntrack` tag.
+func (c *CommandClient) ListConnections() (ConnectionIterator, error) {
+	conn, err := c.directConnect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = binary.Write(conn, binary.BigEndian, uint8(CommandConnections))
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	var length int32
+	err = binary.Read(reader, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	connections := make([]Connection, 0, length)
+	for i := int32(0); i < length; i++ {
+		connection, err := readConnection(reader)
+		if err != nil {
+			return nil, err
+		}
+		connections = append(connections, connection)
+	}
+	return newPtrIterator(connections), nil
+}
+
+func (s *CommandServer) handleConnections(conn net.Conn) error {
+	var connections []Connection
+	for _, closer := range conntrack.Sessions() {
+		if tracked, isTracked := closer.(*trackedConnection); isTracked {
+			connections = append(connections, tracked.connection)
+		}
+	}
+	writer := bufio.NewWriter(conn)
+	err := binary.Write(writer, binary.BigEndian, int32(len(connections)))
+	if err != nil {
+		return err
+	}
+	for _, connection := range connections {
+		err = writeConnection(writer, connection)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func writeConnection(writer io.Writer, connection Connection) error {
+	for _, value := range []string{connection.Network, connection.Source, connection.Destination, connection.InboundTag, connection.Owner} {
+		err := varbin.Write(writer, binary.BigEndian, value)
+		if err != nil {
+			return err
+		}
+	}
+	err := binary.Write(writer, binary.BigEndian, connection.OwnerUID)
+	if err != nil {
+		return err
+	}
+	return binary.Write(writer, binary.BigEndian, connection.CreatedAt)
+}
+
+func readConnection(reader io.Reader) (Connection, error) {
+	var connection Connection
+	for _, value := range []*string{&connection.Network, &connection.Source, &connection.Destination, &connection.InboundTag, &connection.Owner} {
+		var err error
+		*value, err = varbin.ReadValue[string](reader, binary.BigEndian)
+		if err != nil {
+			return Connection{}, err
+		}
+	}
+	err := binary.Read(reader, binary.BigEndian, &connection.OwnerUID)
+	if err != nil {
+		return Connection{}, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &connection.CreatedAt)
+	if err != nil {
+		return Connection{}, err
+	}
+	return connection, nil
+}
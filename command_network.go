@@ -0,0 +1,109 @@
+package libbox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/sagernet/sing/common/varbin"
+)
+
+type NetworkEvent struct {
+	InterfaceName    string
+	InterfaceIndex   int32
+	IsExpensive      bool
+	IsConstrained    bool
+	ConnectionsReset bool
+}
+
+func (s *CommandServer) emitNetworkEvent(event *NetworkEvent) {
+	s.networkSubscriber.Emit(event)
+}
+
+func (s *CommandServer) handleNetworkEventConn(conn net.Conn) error {
+	subscription, done, err := s.networkObserver.Subscribe()
+	if err != nil {
+		return err
+	}
+	defer s.networkObserver.UnSubscribe(subscription)
+	ctx := connKeepAlive(conn)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return nil
+		case event := <-subscription:
+			err = writeNetworkEvent(conn, event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *CommandClient) handleNetworkEventConn(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		event, err := readNetworkEvent(reader)
+		if err != nil {
+			c.handler.Disconnected(err.Error())
+			return
+		}
+		c.handler.WriteNetworkEvent(event)
+	}
+}
+
+func writeNetworkEvent(conn net.Conn, event *NetworkEvent) error {
+	writer := bufio.NewWriter(conn)
+	err := varbin.Write(writer, binary.BigEndian, event.InterfaceName)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(writer, binary.BigEndian, event.InterfaceIndex)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(writer, binary.BigEndian, event.IsExpensive)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(writer, binary.BigEndian, event.IsConstrained)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(writer, binary.BigEndian, event.ConnectionsReset)
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+func readNetworkEvent(reader io.Reader) (*NetworkEvent, error) {
+	var (
+		event NetworkEvent
+		err   error
+	)
+	event.InterfaceName, err = varbin.ReadValue[string](reader, binary.BigEndian)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &event.InterfaceIndex)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &event.IsExpensive)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &event.IsConstrained)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &event.ConnectionsReset)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
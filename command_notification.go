@@ -0,0 +1,49 @@
+package libbox
+
+import (
+	"encoding/binary"
+	"net"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/varbin"
+)
+
+// NotifySubscriptionUpdateFailed asks the running service to notify the user that the app failed
+// to update a subscription, since subscriptions are updated outside the extension.
+func (c *CommandClient) NotifySubscriptionUpdateFailed(name string, message string) error {
+	conn, err := c.directConnect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = binary.Write(conn, binary.BigEndian, uint8(CommandNotifySubscriptionUpdateFailed))
+	if err != nil {
+		return err
+	}
+	err = varbin.Write(conn, binary.BigEndian, name)
+	if err != nil {
+		return err
+	}
+	err = varbin.Write(conn, binary.BigEndian, message)
+	if err != nil {
+		return err
+	}
+	return readError(conn)
+}
+
+func (s *CommandServer) handleNotifySubscriptionUpdateFailed(conn net.Conn) error {
+	name, err := varbin.ReadValue[string](conn, binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	message, err := varbin.ReadValue[string](conn, binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	service := s.getService()
+	if service == nil {
+		return writeError(conn, E.New("service not started"))
+	}
+	service.NotifySubscriptionUpdateFailed(name, message)
+	return writeError(conn, nil)
+}
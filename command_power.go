@@ -71,7 +71,10 @@ func (c *CommandClient) ServiceClose() error {
 }
 
 func (s *CommandServer) handleServiceClose(conn net.Conn) error {
-	rErr := s.service.Close()
+	var rErr error
+	if service := s.getService(); service != nil {
+		rErr = service.Close()
+	}
 	s.handler.PostServiceClose()
 	err := binary.Write(conn, binary.BigEndian, rErr != nil)
 	if err != nil {
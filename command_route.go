@@ -0,0 +1,115 @@
+package libbox
+
+import (
+	"encoding/binary"
+	"net"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/varbin"
+)
+
+// ExplainRoute asks the running service which rule and outbound a TUN flow to the destination,
+// a domain or an IP address, would be routed to. The network is tcp or udp, and the inbound
+// tag is the one tun2ray would use if empty.
+func (c *CommandClient) ExplainRoute(destination string, port int32, network string, inboundTag string) (*RouteExplanation, error) {
+	conn, err := c.directConnect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = binary.Write(conn, binary.BigEndian, uint8(CommandExplainRoute))
+	if err != nil {
+		return nil, err
+	}
+	err = varbin.Write(conn, binary.BigEndian, destination)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(conn, binary.BigEndian, port)
+	if err != nil {
+		return nil, err
+	}
+	err = varbin.Write(conn, binary.BigEndian, network)
+	if err != nil {
+		return nil, err
+	}
+	err = varbin.Write(conn, binary.BigEndian, inboundTag)
+	if err != nil {
+		return nil, err
+	}
+	err = readError(conn)
+	if err != nil {
+		return nil, err
+	}
+	var explanation RouteExplanation
+	err = binary.Read(conn, binary.BigEndian, &explanation.MatchedRule)
+	if err != nil {
+		return nil, err
+	}
+	explanation.BalancerTag, err = varbin.ReadValue[string](conn, binary.BigEndian)
+	if err != nil {
+		return nil, err
+	}
+	explanation.OutboundTag, err = varbin.ReadValue[string](conn, binary.BigEndian)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(conn, binary.BigEndian, &explanation.NetworkPolicy)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(conn, binary.BigEndian, &explanation.Blocked)
+	if err != nil {
+		return nil, err
+	}
+	return &explanation, nil
+}
+
+func (s *CommandServer) handleExplainRoute(conn net.Conn) error {
+	destination, err := varbin.ReadValue[string](conn, binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	var port int32
+	err = binary.Read(conn, binary.BigEndian, &port)
+	if err != nil {
+		return err
+	}
+	network, err := varbin.ReadValue[string](conn, binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	inboundTag, err := varbin.ReadValue[string](conn, binary.BigEndian)
+	if err != nil {
+		return err
+	}
+	service := s.getService()
+	if service == nil {
+		return writeError(conn, E.New("service not started"))
+	}
+	explanation, err := service.explainRoute(destination, port, network, inboundTag)
+	if err != nil {
+		return writeError(conn, err)
+	}
+	err = writeError(conn, nil)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(conn, binary.BigEndian, explanation.MatchedRule)
+	if err != nil {
+		return err
+	}
+	err = varbin.Write(conn, binary.BigEndian, explanation.BalancerTag)
+	if err != nil {
+		return err
+	}
+	err = varbin.Write(conn, binary.BigEndian, explanation.OutboundTag)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(conn, binary.BigEndian, explanation.NetworkPolicy)
+	if err != nil {
+		return err
+	}
+	return binary.Write(conn, binary.BigEndian, explanation.Blocked)
+}
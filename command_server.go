@@ -26,7 +26,12 @@ type CommandServer struct {
 	maxLines   int
 	subscriber *observable.Subscriber[string]
 	observer   *observable.Observer[string]
-	service    *Service
+
+	serviceAccess sync.RWMutex
+	service       *Service
+
+	networkSubscriber *observable.Subscriber[*NetworkEvent]
+	networkObserver   *observable.Observer[*NetworkEvent]
 
 	// These channels only work with a single client. if multi-client support is needed, replace with Subscriber/Observer
 	logReset chan struct{}
@@ -41,17 +46,30 @@ type CommandServerHandler interface {
 
 func NewCommandServer(handler CommandServerHandler, maxLines int32) *CommandServer {
 	server := &CommandServer{
-		handler:    handler,
-		maxLines:   int(maxLines),
-		subscriber: observable.NewSubscriber[string](128),
-		logReset:   make(chan struct{}, 1),
+		handler:           handler,
+		maxLines:          int(maxLines),
+		subscriber:        observable.NewSubscriber[string](128),
+		networkSubscriber: observable.NewSubscriber[*NetworkEvent](8),
+		logReset:          make(chan struct{}, 1),
 	}
 	server.observer = observable.NewObserver[string](server.subscriber, 64)
+	server.networkObserver = observable.NewObserver[*NetworkEvent](server.networkSubscriber, 8)
 	return server
 }
 
 func (s *CommandServer) SetService(newService *Service) {
+	if newService != nil {
+		newService.tun.network.setEventListener(s)
+	}
+	s.serviceAccess.Lock()
 	s.service = newService
+	s.serviceAccess.Unlock()
+}
+
+func (s *CommandServer) getService() *Service {
+	s.serviceAccess.RLock()
+	defer s.serviceAccess.RUnlock()
+	return s.service
 }
 
 func (s *CommandServer) Start() error {
@@ -105,6 +123,7 @@ func (s *CommandServer) Close() error {
 	return common.Close(
 		s.listener,
 		s.observer,
+		s.networkObserver,
 	)
 }
 
@@ -162,12 +181,18 @@ func (s *CommandServer) handleConnection(conn net.Conn) error {
 		return s.handleGetSystemProxyStatus(conn)
 	case CommandSetSystemProxyEnabled:
 		return s.handleSetSystemProxyEnabled(conn)
-	// case CommandConnections:
-	//	return s.handleConnectionsConn(conn)
+	case CommandNetworkEvent:
+		return s.handleNetworkEventConn(conn)
+	case CommandExplainRoute:
+		return s.handleExplainRoute(conn)
+	case CommandConnections:
+		return s.handleConnections(conn)
 	// case CommandCloseConnection:
 	//	return s.handleCloseConnection(conn)
 	// case CommandGetDeprecatedNotes:
 	//	return s.handleGetDeprecatedNotes(conn)
+	case CommandNotifySubscriptionUpdateFailed:
+		return s.handleNotifySubscriptionUpdateFailed(conn)
 	default:
 		return E.New("unknown command: ", command)
 	}
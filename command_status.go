@@ -13,8 +13,10 @@ import (
 )
 
 type StatusMessage struct {
-	Memory           int64
-	Goroutines       int32
+	Memory     int64
+	Goroutines int32
+	// ConnectionsIn counts TUN sessions, and ConnectionsOut counts tracked outbound connections.
+	// Both are only counted if the library is built with the `with_conntrack` tag.
 	ConnectionsIn    int32
 	ConnectionsOut   int32
 	TrafficAvailable bool
@@ -22,13 +24,19 @@ type StatusMessage struct {
 	Downlink         int64
 	UplinkTotal      int64
 	DownlinkTotal    int64
+	IsExpensive      bool
+	IsConstrained    bool
 }
 
 func (s *CommandServer) readStatus() StatusMessage {
 	var message StatusMessage
 	message.Memory = int64(memory.Inuse())
 	message.Goroutines = int32(runtime.NumGoroutine())
+	message.ConnectionsIn = int32(conntrack.SessionCount())
 	message.ConnectionsOut = int32(conntrack.Count())
+	if service := s.getService(); service != nil {
+		message.IsExpensive, message.IsConstrained = service.tun.network.networkState()
+	}
 	return message
 }
 
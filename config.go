@@ -1,14 +1,23 @@
 package libbox
 
 import (
+	"bytes"
 	"context"
+	stdjson "encoding/json"
+	"io"
+	"strings"
+	"time"
 
 	"github.com/sagernet/sing/common"
 	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
 	"github.com/sagernet/sing/common/json"
+	"github.com/sagernet/sing/common/json/badoption"
 	"github.com/v2fly/v2ray-core/v5"
 	"github.com/v2fly/v2ray-core/v5/common/log"
+	"github.com/v2fly/v2ray-core/v5/common/session"
 	"github.com/v2fly/v2ray-core/v5/infra/conf/cfgcommon"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/cfgcommon/sniffer"
 	"github.com/v2fly/v2ray-core/v5/infra/conf/geodata"
 	"github.com/v2fly/v2ray-core/v5/infra/conf/v5cfg"
 )
@@ -17,25 +26,250 @@ func init() {
 	log.RegisterHandler((*stubLogger)(nil))
 }
 
-func parseConfig(configContent string) (*core.Config, error) {
-	rootConfig, err := json.UnmarshalExtended[v5cfg.RootConfig]([]byte(configContent))
+// libboxConfig holds the keys added to V2Ray configs by libbox, in both formats.
+type libboxConfig struct {
+	TUN     tunConfig     `json:"tun"`
+	Network networkConfig `json:"network"`
+}
+
+type rootConfig struct {
+	v5cfg.RootConfig
+	libboxConfig
+}
+
+// parsedConfig is the result of parseConfig independent of the config format.
+type parsedConfig struct {
+	libboxConfig
+	format       string
+	outboundTags []string
+	routingRules []routingRuleSource
+}
+
+type tunConfig struct {
+	// PacketAddr dispatches one link per UDP source and encodes the destination of
+	// each packet with packetaddr, so that outbounds can provide full-cone NAT.
+	PacketAddr bool `json:"packetAddr"`
+	// DNSHijack selects the flows treated as DNS: "port" for any flow to port 53 (default),
+	// "tun" for the advertised TUN DNS address only, or "none". Flows to port 853 of the same
+	// servers are rejected, so that resolvers fall back from encrypted to plain DNS.
+	DNSHijack string `json:"dnsHijack"`
+	// DNSResponder answers hijacked queries from the V2Ray DNS client in process
+	// instead of dispatching them as connections.
+	DNSResponder bool `json:"dnsResponder"`
+	// FindProcess looks up the owner of each connection and attaches it to the inbound user
+	// and the `uid` and `package` content attributes.
+	FindProcess bool `json:"findProcess"`
+	// InboundTag is the inbound tag of TUN flows, "injectedTun" by default.
+	InboundTag string `json:"inboundTag"`
+	// SplitInbound appends the flow kind to the inbound tag, one of "-tcp4", "-tcp6", "-udp" and "-dns".
+	SplitInbound bool `json:"splitInbound"`
+	// Sniffing overrides the default sniffing request, which only sniffs the protocol.
+	Sniffing *tunSniffingConfig `json:"sniffing"`
+}
+
+type tunSniffingConfig struct {
+	Enabled      bool     `json:"enabled"`
+	DestOverride []string `json:"destOverride"`
+	MetadataOnly bool     `json:"metadataOnly"`
+	// RouteOnly uses the sniffed domain for routing only, and keeps connecting to the original address.
+	RouteOnly bool `json:"routeOnly"`
+	// DomainsExcluded skips destination override for these domains and their subdomains.
+	DomainsExcluded []string `json:"domainsExcluded"`
+}
+
+func (c *tunSniffingConfig) build() (session.SniffingRequest, error) {
+	if c == nil {
+		return session.SniffingRequest{Enabled: true}, nil
+	}
+	config, err := (&sniffer.SniffingConfig{
+		Enabled:      c.Enabled,
+		DestOverride: (*cfgcommon.StringList)(&c.DestOverride),
+		MetadataOnly: c.MetadataOnly,
+	}).Build()
 	if err != nil {
-		return nil, E.Cause(err, "parse config")
+		return session.SniffingRequest{}, err
+	}
+	return session.SniffingRequest{
+		Enabled:                        config.Enabled,
+		OverrideDestinationForProtocol: config.DestinationOverride,
+		MetadataOnly:                   config.MetadataOnly,
+	}, nil
+}
+
+func (c *tunConfig) check() error {
+	switch c.DNSHijack {
+	case "", dnsHijackPort, dnsHijackTUN, dnsHijackNone:
+	default:
+		return E.New("unknown dns hijack mode: ", c.DNSHijack)
+	}
+	_, err := c.Sniffing.build()
+	if err != nil {
+		return E.Cause(err, "build sniffing options")
+	}
+	return nil
+}
+
+type networkConfig struct {
+	// ResetOnInterfaceChange closes connections and flushes DNS caches when the default interface changes.
+	ResetOnInterfaceChange bool `json:"resetOnInterfaceChange"`
+	// ChangeDelay debounces default interface changes, one second by default.
+	ChangeDelay badoption.Duration `json:"changeDelay"`
+	// Expensive applies to TUN flows when the default interface is expensive, such as cellular.
+	Expensive *networkPolicy `json:"expensive"`
+	// Constrained applies to TUN flows when the default interface is constrained, such as in Low Data Mode.
+	Constrained *networkPolicy `json:"constrained"`
+	// WIFI applies the policy of the first rule matching the connected WIFI network,
+	// such as sending everything direct on trusted home networks. It takes precedence over the others.
+	WIFI []wifiRule `json:"wifi"`
+}
+
+type networkPolicy struct {
+	// OutboundTag sends all flows except DNS to this outbound, skipping routing rules.
+	OutboundTag string `json:"outboundTag"`
+	// BlockAllUDP rejects every UDP flow except hijacked DNS, regardless of its size, so that QUIC
+	// and other bulk UDP traffic falls back to TCP. UDP-only apps such as calls and games stop working.
+	BlockAllUDP bool `json:"blockAllUDP"`
+}
+
+type wifiRule struct {
+	SSID  []string `json:"ssid"`
+	BSSID []string `json:"bssid"`
+	networkPolicy
+}
+
+func (r *wifiRule) match(state WIFIState) bool {
+	if state.SSID == "" && state.BSSID == "" {
+		return false
+	}
+	if len(r.SSID) > 0 && !common.Contains(r.SSID, state.SSID) {
+		return false
+	}
+	if len(r.BSSID) > 0 && !common.Any(r.BSSID, func(it string) bool {
+		return strings.EqualFold(it, state.BSSID)
+	}) {
+		return false
+	}
+	return len(r.SSID) > 0 || len(r.BSSID) > 0
+}
+
+func (c *networkConfig) changeDelay() time.Duration {
+	if c.ChangeDelay > 0 {
+		return c.ChangeDelay.Build()
+	}
+	return time.Second
+}
+
+// warnings reports options that are accepted but likely not doing what the user expects.
+func (c *parsedConfig) warnings() []string {
+	return common.Map(c.diagnostics(), func(it configWarning) string {
+		return F.ToString(it.path, ": ", it.message)
+	})
+}
+
+func (c *parsedConfig) diagnostics() []configWarning {
+	var warnings []configWarning
+	outboundTags := c.outboundTags
+	checkPolicy := func(path string, policy *networkPolicy) {
+		if policy != nil && policy.OutboundTag != "" && !common.Contains(outboundTags, policy.OutboundTag) {
+			warnings = append(warnings, configWarning{path + ".outboundTag", F.ToString("outbound ", policy.OutboundTag, " not found")})
+		}
+	}
+	checkPolicy("network.expensive", c.Network.Expensive)
+	checkPolicy("network.constrained", c.Network.Constrained)
+	for i := range c.Network.WIFI {
+		rule := &c.Network.WIFI[i]
+		path := jsonIndexPath("network.wifi", i)
+		if len(rule.SSID) == 0 && len(rule.BSSID) == 0 {
+			warnings = append(warnings, configWarning{path, "missing ssid or bssid, rule never matches"})
+		}
+		checkPolicy(path, &rule.networkPolicy)
+	}
+	return warnings
+}
+
+func parseConfig(configContent string, format string) (*parsedConfig, *core.Config, error) {
+	if format != ConfigFormatAuto {
+		return parseConfigWithFormat(configContent, format)
+	}
+	format = detectConfigFormat([]byte(configContent))
+	options, config, err := parseConfigWithFormat(configContent, format)
+	if err != nil {
+		return nil, nil, E.Cause(err, "detected ", format, " format")
+	}
+	return options, config, nil
+}
+
+func parseConfigWithFormat(configContent string, format string) (*parsedConfig, *core.Config, error) {
+	switch format {
+	case ConfigFormatV5:
+		return parseV5Config(configContent)
+	case ConfigFormatV4:
+		return parseV4Config(configContent)
+	default:
+		return nil, nil, E.New("unknown config format: ", format)
+	}
+}
+
+func parseV5Config(configContent string) (*parsedConfig, *core.Config, error) {
+	options, err := json.UnmarshalExtended[rootConfig]([]byte(configContent))
+	if err != nil {
+		return nil, nil, E.Cause(err, "parse v5 config")
+	}
+	err = options.TUN.check()
+	if err != nil {
+		return nil, nil, E.Cause(err, "check tun options")
 	}
 	buildCtx := cfgcommon.NewConfigureLoadingContext(context.Background())
 	cfgcommon.SetGeoDataLoader(buildCtx, common.Must1(geodata.GetGeoDataLoader("memconservative")))
-	message, err := rootConfig.BuildV5(buildCtx)
+	message, err := options.BuildV5(buildCtx)
 	if err != nil {
-		return nil, E.Cause(err, "build config")
+		return nil, nil, E.Cause(err, "build v5 config")
 	}
-	return message.(*core.Config), nil
+	config := message.(*core.Config)
+	routingRules, err := routingRuleSources(config)
+	if err != nil {
+		return nil, nil, E.Cause(err, "read routing rules")
+	}
+	return &parsedConfig{
+		libboxConfig: options.libboxConfig,
+		format:       ConfigFormatV5,
+		outboundTags: common.Map(options.Outbounds, func(it v5cfg.OutboundConfig) string {
+			return it.Tag
+		}),
+		routingRules: routingRules,
+	}, config, nil
 }
 
 func CheckConfig(configContent string) error {
-	_, err := parseConfig(configContent)
+	return CheckConfigWithFormat(configContent, ConfigFormatAuto)
+}
+
+func CheckConfigWithFormat(configContent string, format string) error {
+	_, _, err := parseConfig(configContent, format)
 	return err
 }
 
+// FormatConfig re-emits the config as indented JSON without comments, with well-known
+// root keys in schema order and other keys sorted, so that equal configs format equally.
 func FormatConfig(configContent string) (*StringBox, error) {
-	return nil, E.New("format config is not supported by V2Ray")
+	// sing json does not export its Number type, so the standard decoder reads the filtered content
+	decoder := stdjson.NewDecoder(json.NewCommentFilter(strings.NewReader(configContent)))
+	decoder.UseNumber()
+	var content any
+	err := decoder.Decode(&content)
+	if err != nil {
+		return nil, E.Cause(err, "parse config")
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return nil, E.New("parse config: unexpected data after the top-level object")
+	}
+	if _, isObject := content.(map[string]any); !isObject {
+		return nil, E.New("parse config: not a JSON object")
+	}
+	var buffer bytes.Buffer
+	err = writeFormattedJSON(&buffer, content, "", rootKeyOrder)
+	if err != nil {
+		return nil, err
+	}
+	return wrapString(buffer.String()), nil
 }
@@ -0,0 +1,603 @@
+package libbox
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sagernet/sing/common"
+	F "github.com/sagernet/sing/common/format"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/geodata"
+)
+
+const (
+	ConfigDiagnosticSeverityError   = "error"
+	ConfigDiagnosticSeverityWarning = "warning"
+)
+
+type ConfigDiagnostic struct {
+	Severity string
+	// Path is the JSON path of the problem such as `outbounds[1].tag`, empty for the whole config.
+	Path string
+	// Line and Column are 1-based, Column counts characters.
+	Line    int32
+	Column  int32
+	Message string
+}
+
+type ConfigDiagnosticIterator interface {
+	Next() *ConfigDiagnostic
+	HasNext() bool
+}
+
+// CheckConfigDiagnostics reports the error of CheckConfigWithFormat and warnings for
+// unused outbounds, unreachable routing rules and missing geosite/geoip categories.
+func CheckConfigDiagnostics(configContent string, format string) ConfigDiagnosticIterator {
+	source := newConfigSource(configContent)
+	var diagnostics []ConfigDiagnostic
+	options, _, err := parseConfig(configContent, format)
+	if err != nil {
+		diagnostic := ConfigDiagnostic{
+			Severity: ConfigDiagnosticSeverityError,
+			Message:  err.Error(),
+		}
+		// the parse error of sing json is not located in the original content
+		var syntaxError *stdjson.SyntaxError
+		if errors.As(source.err, &syntaxError) {
+			// the offset is after the invalid character
+			offset := int(syntaxError.Offset) - 1
+			diagnostic.Path = source.pathAt(offset)
+			diagnostic.Line, diagnostic.Column = source.position(source.originalOffset(offset))
+		} else if value, found := source.typeErrorValue(format); found {
+			diagnostic.Path = value.path
+			diagnostic.Line, diagnostic.Column = source.position(source.originalOffset(value.offset))
+		} else {
+			diagnostic.Line, diagnostic.Column = 1, 1
+		}
+		diagnostics = append(diagnostics, diagnostic)
+	} else {
+		for _, warning := range options.diagnostics() {
+			diagnostics = append(diagnostics, source.diagnostic(ConfigDiagnosticSeverityWarning, warning.path, warning.message))
+		}
+	}
+	if source.err == nil {
+		if format == ConfigFormatAuto {
+			format = detectConfigFormat([]byte(configContent))
+		}
+		for _, warning := range checkConfigContent(source.value, format) {
+			diagnostics = append(diagnostics, source.diagnostic(ConfigDiagnosticSeverityWarning, warning.path, warning.message))
+		}
+	}
+	slices.SortStableFunc(diagnostics, func(a, b ConfigDiagnostic) int {
+		if a.Line != b.Line {
+			return int(a.Line - b.Line)
+		}
+		return int(a.Column - b.Column)
+	})
+	return newPtrIterator(diagnostics)
+}
+
+type configWarning struct {
+	path    string
+	message string
+}
+
+// configSource locates JSON paths in the original content, including comments.
+type configSource struct {
+	content  string
+	filtered []byte
+	// offsets maps each byte of the content without comments to the original content.
+	offsets []int
+	values  []configValue
+	value   jsonObject
+	err     error
+}
+
+type configValue struct {
+	path   string
+	offset int
+}
+
+func newConfigSource(content string) *configSource {
+	source := &configSource{content: content}
+	source.filtered = source.stripComments()
+	decoder := stdjson.NewDecoder(bytes.NewReader(source.filtered))
+	decoder.UseNumber()
+	source.err = decoder.Decode(&source.value)
+	source.locate(source.filtered)
+	return source
+}
+
+// typeErrorValue locates the value of a type error in the config options.
+// The type error of sing json is not exported, so the content is decoded again with the standard decoder.
+func (s *configSource) typeErrorValue(format string) (configValue, bool) {
+	if format == ConfigFormatAuto {
+		format = detectConfigFormat(s.filtered)
+	}
+	var err error
+	if format == ConfigFormatV4 {
+		err = stdjson.Unmarshal(s.filtered, new(v4RootConfig))
+	} else {
+		err = stdjson.Unmarshal(s.filtered, new(rootConfig))
+	}
+	var typeError *stdjson.UnmarshalTypeError
+	if !errors.As(err, &typeError) || typeError.Field == "" {
+		return configValue{}, false
+	}
+	// the offset is after the value, but it is relative to the inner content
+	// if the error comes from an UnmarshalJSON method, so the field must match
+	if value, found := s.valueAt(int(typeError.Offset) - 1); found && jsonFieldMatches(value.path, typeError.Field) {
+		return value, true
+	}
+	for _, value := range s.values {
+		if jsonFieldMatches(value.path, typeError.Field) {
+			return value, true
+		}
+	}
+	return configValue{}, false
+}
+
+// jsonFieldMatches reports whether the path matches the field of a type error, such as `outbounds.1.tag`,
+// or `outbounds.tag` before Go 1.24.
+func jsonFieldMatches(path string, field string) bool {
+	var dotted, stripped strings.Builder
+	for len(path) > 0 {
+		start := strings.IndexByte(path, '[')
+		if start < 0 {
+			dotted.WriteString(path)
+			stripped.WriteString(path)
+			break
+		}
+		end := strings.IndexByte(path[start:], ']') + start
+		dotted.WriteString(path[:start])
+		dotted.WriteString(".")
+		dotted.WriteString(path[start+1 : end])
+		stripped.WriteString(path[:start])
+		path = path[end+1:]
+	}
+	return field == dotted.String() || field == stripped.String()
+}
+
+// stripComments removes comments like json.NewCommentFilter does and records original offsets.
+func (s *configSource) stripComments() []byte {
+	const (
+		stateContent = iota
+		stateDoubleQuote
+		stateDoubleQuoteEscape
+		stateSingleQuote
+		stateSingleQuoteEscape
+		stateComment
+		stateSlash
+		stateMultilineComment
+		stateMultilineCommentStar
+	)
+	var (
+		filtered []byte
+		state    int
+	)
+	emit := func(x byte, offset int) {
+		filtered = append(filtered, x)
+		s.offsets = append(s.offsets, offset)
+	}
+	for i := 0; i < len(s.content); i++ {
+		x := s.content[i]
+		switch state {
+		case stateContent:
+			switch x {
+			case '"':
+				state = stateDoubleQuote
+			case '\'':
+				state = stateSingleQuote
+			case '#':
+				state = stateComment
+				continue
+			case '/':
+				state = stateSlash
+				continue
+			}
+			emit(x, i)
+		case stateDoubleQuote, stateSingleQuote:
+			switch {
+			case x == '\\':
+				state++
+			case x == '"' && state == stateDoubleQuote, x == '\'' && state == stateSingleQuote:
+				state = stateContent
+			}
+			emit(x, i)
+		case stateDoubleQuoteEscape, stateSingleQuoteEscape:
+			state--
+			emit(x, i)
+		case stateComment:
+			if x == '\n' {
+				state = stateContent
+				emit(x, i)
+			}
+		case stateSlash:
+			switch x {
+			case '/':
+				state = stateComment
+			case '*':
+				state = stateMultilineComment
+			default:
+				state = stateContent
+				emit('/', i-1)
+				emit(x, i)
+			}
+		case stateMultilineComment, stateMultilineCommentStar:
+			switch {
+			case x == '/' && state == stateMultilineCommentStar:
+				state = stateContent
+			case x == '*':
+				state = stateMultilineCommentStar
+			default:
+				state = stateMultilineComment
+				if x == '\n' {
+					emit(x, i)
+				}
+			}
+		}
+	}
+	return filtered
+}
+
+func (s *configSource) locate(filtered []byte) {
+	type frame struct {
+		path    string
+		isArray bool
+		index   int
+		key     string
+		hasKey  bool
+	}
+	valueDone := func(f *frame) {
+		if f.isArray {
+			f.index++
+		} else {
+			f.hasKey = false
+		}
+	}
+	decoder := stdjson.NewDecoder(bytes.NewReader(filtered))
+	var stack []*frame
+	for {
+		offset := int(decoder.InputOffset())
+		for offset < len(filtered) && strings.IndexByte(" \t\r\n,:", filtered[offset]) >= 0 {
+			offset++
+		}
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+		var parent *frame
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1]
+		}
+		if delim, isDelim := token.(stdjson.Delim); isDelim && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 {
+				valueDone(stack[len(stack)-1])
+			}
+			continue
+		}
+		if parent != nil && !parent.isArray && !parent.hasKey {
+			parent.key, _ = token.(string)
+			parent.hasKey = true
+			continue
+		}
+		var path string
+		if parent != nil {
+			if parent.isArray {
+				path = jsonIndexPath(parent.path, parent.index)
+			} else {
+				path = jsonKeyPath(parent.path, parent.key)
+			}
+		}
+		s.values = append(s.values, configValue{path, offset})
+		if delim, isDelim := token.(stdjson.Delim); isDelim {
+			stack = append(stack, &frame{path: path, isArray: delim == '['})
+		} else if parent != nil {
+			valueDone(parent)
+		}
+	}
+}
+
+func jsonKeyPath(parent string, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func jsonIndexPath(parent string, index int) string {
+	return parent + "[" + strconv.Itoa(index) + "]"
+}
+
+func (s *configSource) originalOffset(offset int) int {
+	if offset < 0 {
+		return 0
+	}
+	if offset >= len(s.offsets) {
+		return len(s.content)
+	}
+	return s.offsets[offset]
+}
+
+// pathAt returns the path of the last value starting before the offset in the content without comments.
+func (s *configSource) pathAt(offset int) string {
+	value, _ := s.valueAt(offset)
+	return value.path
+}
+
+func (s *configSource) valueAt(offset int) (configValue, bool) {
+	var (
+		value configValue
+		found bool
+	)
+	for _, it := range s.values {
+		if it.offset > offset {
+			break
+		}
+		value, found = it, true
+	}
+	return value, found
+}
+
+func (s *configSource) position(offset int) (line int32, column int32) {
+	prefix := s.content[:min(offset, len(s.content))]
+	line = int32(strings.Count(prefix, "\n") + 1)
+	column = int32(utf8.RuneCountInString(prefix[strings.LastIndexByte(prefix, '\n')+1:]) + 1)
+	return
+}
+
+func (s *configSource) diagnostic(severity string, path string, message string) ConfigDiagnostic {
+	diagnostic := ConfigDiagnostic{
+		Severity: severity,
+		Path:     path,
+		Message:  message,
+		Line:     1,
+		Column:   1,
+	}
+	for _, value := range s.values {
+		if value.path == path {
+			diagnostic.Line, diagnostic.Column = s.position(s.originalOffset(value.offset))
+			break
+		}
+	}
+	return diagnostic
+}
+
+// routingRule is a routing rule of either format, with the target and option keys removed.
+type routingRule struct {
+	path       string
+	conditions map[string][]string
+}
+
+var routingRuleOptionKeys = []string{
+	"type", "tag", "outboundTag", "balancerTag", "balancingTag", "balancing_tag", "ruleTag",
+	"domainMatcher", "domain_matcher",
+}
+
+func checkConfigContent(content jsonObject, format string) []configWarning {
+	var (
+		warnings   []configWarning
+		rulesPath  string
+		rules      []any
+		selectors  []string
+		ruleObject jsonObject
+	)
+	if format == ConfigFormatV4 {
+		ruleObject = content.object("routing")
+		rulesPath = "routing.rules"
+		rules, _ = ruleObject.field("rules").([]any)
+		balancers, _ := ruleObject.field("balancers").([]any)
+		for _, balancer := range balancers {
+			selectors = append(selectors, jsonObject(asObject(balancer)).strings("selector")...)
+		}
+	} else {
+		ruleObject = content.object("router")
+		rulesPath = "router.rule"
+		rules, _ = ruleObject.field("rule").([]any)
+		balancers, _ := ruleObject.field("balancingRule", "balancing_rule").([]any)
+		for _, balancer := range balancers {
+			selectors = append(selectors, jsonObject(asObject(balancer)).strings("outboundSelector", "outbound_selector")...)
+		}
+	}
+	warnings = append(warnings, checkUnusedOutbounds(content, selectors)...)
+	warnings = append(warnings, checkUnreachableRules(rulesPath, rules)...)
+	warnings = append(warnings, checkGeoCategories(content)...)
+	return warnings
+}
+
+func asObject(value any) map[string]any {
+	object, _ := value.(map[string]any)
+	return object
+}
+
+// checkUnusedOutbounds reports outbounds other than the default one whose tag is not
+// referenced anywhere, such as by routing rules, balancers, proxy settings or network policies.
+func checkUnusedOutbounds(content jsonObject, selectors []string) []configWarning {
+	references := make(map[string]bool)
+	var walk func(path string, value any)
+	walk = func(path string, value any) {
+		switch value := value.(type) {
+		case map[string]any:
+			for key, item := range value {
+				walk(jsonKeyPath(path, key), item)
+			}
+		case []any:
+			for i, item := range value {
+				walk(jsonIndexPath(path, i), item)
+			}
+		case string:
+			references[value] = true
+		}
+	}
+	for key, value := range content {
+		if key != "inbounds" && key != "outbounds" {
+			walk(key, value)
+			continue
+		}
+		proxies, _ := value.([]any)
+		for i, proxy := range proxies {
+			for proxyKey, item := range asObject(proxy) {
+				if proxyKey != "tag" {
+					walk(jsonKeyPath(jsonIndexPath(key, i), proxyKey), item)
+				}
+			}
+		}
+	}
+	var warnings []configWarning
+	outbounds, _ := content.field("outbounds").([]any)
+	for i, outbound := range outbounds {
+		tag := jsonObject(asObject(outbound)).string("tag")
+		if i == 0 || tag == "" || references[tag] || common.Any(selectors, func(it string) bool {
+			return strings.HasPrefix(tag, it)
+		}) {
+			continue
+		}
+		warnings = append(warnings, configWarning{
+			path:    jsonIndexPath("outbounds", i),
+			message: F.ToString("outbound ", tag, " is not the default outbound and never referenced"),
+		})
+	}
+	return warnings
+}
+
+// checkUnreachableRules reports rules shadowed by an earlier rule, which matches whenever
+// the rule does since each of its conditions accepts a superset of values.
+func checkUnreachableRules(rulesPath string, rules []any) []configWarning {
+	var (
+		warnings []configWarning
+		previous []routingRule
+	)
+	for i, rawRule := range rules {
+		rule := routingRule{
+			path:       jsonIndexPath(rulesPath, i),
+			conditions: make(map[string][]string),
+		}
+		for key, value := range asObject(rawRule) {
+			if slices.Contains(routingRuleOptionKeys, key) {
+				continue
+			}
+			if array, isArray := value.([]any); isArray {
+				rule.conditions[key] = common.Map(array, formatConditionValue)
+			} else {
+				rule.conditions[key] = []string{formatConditionValue(value)}
+			}
+		}
+		for _, previousRule := range previous {
+			if previousRule.shadows(rule) {
+				warnings = append(warnings, configWarning{
+					path:    rule.path,
+					message: F.ToString("routing rule is unreachable, ", previousRule.path, " matches first"),
+				})
+				break
+			}
+		}
+		previous = append(previous, rule)
+	}
+	return warnings
+}
+
+func formatConditionValue(value any) string {
+	var buffer bytes.Buffer
+	_ = writeFormattedJSON(&buffer, value, "", objectKeyOrder)
+	return buffer.String()
+}
+
+func (r *routingRule) shadows(rule routingRule) bool {
+	if len(r.conditions) == 0 {
+		return false
+	}
+	for key, values := range r.conditions {
+		ruleValues, loaded := rule.conditions[key]
+		if !loaded || len(ruleValues) == 0 {
+			return false
+		}
+		for _, value := range ruleValues {
+			if !common.Contains(values, value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// v4IPRuleKeys are v4 keys whose `ext:` entries refer to geoip files.
+var v4IPRuleKeys = []string{"ip", "source", "expectIPs", "expectIps"}
+
+// checkGeoCategories reports geosite and geoip references that can not be loaded, both
+// v4 strings such as `geosite:cn` and v5 objects such as `{"code": "cn"}`.
+func checkGeoCategories(content jsonObject) []configWarning {
+	loader := common.Must1(geodata.GetGeoDataLoader("memconservative"))
+	loadErrors := make(map[string]error)
+	var warnings []configWarning
+	check := func(path string, isSite bool, fileName string, code string) {
+		kind := "geoip"
+		if isSite {
+			kind = "geosite"
+		}
+		cacheKey := F.ToString(kind, ":", fileName, ":", code)
+		err, loaded := loadErrors[cacheKey]
+		if !loaded {
+			if isSite {
+				_, err = loader.LoadGeoSiteWithAttr(fileName, code)
+			} else {
+				_, err = loader.LoadIP(fileName, code)
+			}
+			loadErrors[cacheKey] = err
+		}
+		if err != nil {
+			warnings = append(warnings, configWarning{
+				path:    path,
+				message: F.ToString(kind, " category ", code, " not found in ", fileName, ": ", err),
+			})
+		}
+	}
+	var walk func(path string, key string, value any)
+	walk = func(path string, key string, value any) {
+		switch value := value.(type) {
+		case map[string]any:
+			for itemKey, item := range value {
+				walk(jsonKeyPath(path, itemKey), itemKey, item)
+			}
+		case []any:
+			for i, item := range value {
+				itemPath := jsonIndexPath(path, i)
+				geoObject := jsonObject(asObject(item))
+				code := geoObject.string("code")
+				switch {
+				case code != "" && (key == "geoDomain" || key == "geo_domain"):
+					check(itemPath, true, valueOrDefault(geoObject.string("filePath", "file_path"), "geosite.dat"), code)
+				case code != "" && (key == "geoip" || key == "sourceGeoip" || key == "source_geoip"):
+					check(itemPath, false, valueOrDefault(geoObject.string("filePath", "file_path"), "geoip.dat"), code)
+				default:
+					walk(itemPath, key, item)
+				}
+			}
+		case string:
+			switch {
+			case strings.HasPrefix(value, "geosite:"):
+				check(path, true, "geosite.dat", strings.TrimPrefix(value, "geosite:"))
+			case strings.HasPrefix(value, "geoip:"):
+				check(path, false, "geoip.dat", strings.TrimPrefix(strings.TrimPrefix(value, "geoip:"), "!"))
+			case strings.HasPrefix(value, "ext:"), strings.HasPrefix(value, "ext-domain:"), strings.HasPrefix(value, "ext-ip:"):
+				prefix, resource, _ := strings.Cut(value, ":")
+				fileName, code, found := strings.Cut(resource, ":")
+				if !found {
+					return
+				}
+				isSite := prefix == "ext-domain" || prefix == "ext" && !slices.Contains(v4IPRuleKeys, key)
+				check(path, isSite, fileName, strings.TrimPrefix(code, "!"))
+			}
+		}
+	}
+	for key, value := range content {
+		if key == "router" || key == "routing" || key == "dns" {
+			walk(key, key, value)
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,124 @@
+package libbox
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"os"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/json"
+	"github.com/v2fly/v2ray-core/v5"
+	v4 "github.com/v2fly/v2ray-core/v5/infra/conf/v4"
+)
+
+const (
+	ConfigFormatAuto = ""
+	ConfigFormatV5   = "v5"
+	// ConfigFormatV4 is the legacy V2Ray format, also used by Xray.
+	ConfigFormatV4 = "v4"
+)
+
+type v4RootConfig struct {
+	v4.Config
+	libboxConfig
+}
+
+var (
+	v4OnlyKeys = []string{
+		"routing", "policy", "api", "stats", "reverse", "fakeDns", "browserForwarder",
+		"observatory", "burstObservatory", "multiObservatory", "transport",
+		"inbound", "outbound", "inboundDetour", "outboundDetour",
+	}
+	v5OnlyKeys         = []string{"router", "extension"}
+	v4OnlySettingsKeys = []string{"vnext", "servers", "clients", "fallbacks"}
+	v4OnlyStreamKeys   = []string{
+		"network", "tlsSettings", "xtlsSettings", "realitySettings", "tcpSettings", "kcpSettings",
+		"wsSettings", "httpSettings", "quicSettings", "grpcSettings", "sockopt",
+	}
+	v5OnlyStreamKeys = []string{"transport", "transportSettings", "securitySettings", "socketSettings"}
+)
+
+type formatDetectConfig struct {
+	Log       map[string]json.RawMessage `json:"log"`
+	Inbounds  []formatDetectProxy        `json:"inbounds"`
+	Outbounds []formatDetectProxy        `json:"outbounds"`
+}
+
+type formatDetectProxy struct {
+	Settings       map[string]json.RawMessage `json:"settings"`
+	StreamSettings map[string]json.RawMessage `json:"streamSettings"`
+}
+
+// detectConfigFormat tells v4 configs from v5 by keys only available in one format, v5 is assumed otherwise.
+func detectConfigFormat(content []byte) string {
+	rootKeys, err := json.UnmarshalExtended[map[string]json.RawMessage](content)
+	if err != nil {
+		return ConfigFormatV5
+	}
+	hasAnyKey := func(object map[string]json.RawMessage, keys []string) bool {
+		return common.Any(keys, func(it string) bool {
+			_, loaded := object[it]
+			return loaded
+		})
+	}
+	switch {
+	case hasAnyKey(rootKeys, v5OnlyKeys):
+		return ConfigFormatV5
+	case hasAnyKey(rootKeys, v4OnlyKeys):
+		return ConfigFormatV4
+	}
+	options, err := json.UnmarshalExtended[formatDetectConfig](content)
+	if err != nil {
+		return ConfigFormatV5
+	}
+	// v4 uses a level name, v5 an object for each log
+	if logLevel, loaded := options.Log["loglevel"]; loaded && bytes.HasPrefix(bytes.TrimSpace(logLevel), []byte("\"")) {
+		return ConfigFormatV4
+	}
+	for _, proxy := range append(options.Inbounds, options.Outbounds...) {
+		switch {
+		case hasAnyKey(proxy.StreamSettings, v5OnlyStreamKeys):
+			return ConfigFormatV5
+		case hasAnyKey(proxy.StreamSettings, v4OnlyStreamKeys), hasAnyKey(proxy.Settings, v4OnlySettingsKeys):
+			return ConfigFormatV4
+		}
+	}
+	return ConfigFormatV5
+}
+
+// The v4 config builder, like the simplified router and DNS configs of v5, has no option for the geodata
+// loader and reads it from the environment, so the memory conservative one is selected once for the process.
+func init() {
+	os.Setenv("V2RAY_CONF_GEOLOADER", "memconservative")
+}
+
+func parseV4Config(configContent string) (*parsedConfig, *core.Config, error) {
+	options, err := json.UnmarshalExtended[v4RootConfig]([]byte(configContent))
+	if err != nil {
+		return nil, nil, E.Cause(err, "parse v4 config")
+	}
+	err = options.TUN.check()
+	if err != nil {
+		return nil, nil, E.Cause(err, "check tun options")
+	}
+	config, err := options.Build()
+	if err != nil {
+		return nil, nil, E.Cause(err, "build v4 config")
+	}
+	var routingRules []routingRuleSource
+	if options.RouterConfig != nil {
+		// the rules are read after the build, which appends the deprecated settings rules to them
+		routingRules = common.Map(options.RouterConfig.RuleList, func(it stdjson.RawMessage) routingRuleSource {
+			return v4RoutingRule{it, options.RouterConfig.DomainMatcher}
+		})
+	}
+	return &parsedConfig{
+		libboxConfig: options.libboxConfig,
+		format:       ConfigFormatV4,
+		outboundTags: common.Map(options.OutboundConfigs, func(it v4.OutboundDetourConfig) string {
+			return it.Tag
+		}),
+		routingRules: routingRules,
+	}, config, nil
+}
@@ -0,0 +1,103 @@
+package libbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var (
+	rootKeyOrder   = []string{"log", "dns", "router", "inbounds", "outbounds", "services", "extension", "tun", "network"}
+	objectKeyOrder = []string{"@type", "protocol", "tag", "type"}
+)
+
+func writeFormattedJSON(buffer *bytes.Buffer, value any, indent string, keyOrder []string) error {
+	switch value := value.(type) {
+	case map[string]any:
+		if len(value) == 0 {
+			buffer.WriteString("{}")
+			return nil
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, func(a, b string) int {
+			return compareKeys(a, b, keyOrder)
+		})
+		buffer.WriteString("{\n")
+		for i, key := range keys {
+			buffer.WriteString(indent + "  ")
+			writeJSONString(buffer, key)
+			buffer.WriteString(": ")
+			err := writeFormattedJSON(buffer, value[key], indent+"  ", objectKeyOrder)
+			if err != nil {
+				return err
+			}
+			if i < len(keys)-1 {
+				buffer.WriteByte(',')
+			}
+			buffer.WriteByte('\n')
+		}
+		buffer.WriteString(indent + "}")
+	case []any:
+		if len(value) == 0 {
+			buffer.WriteString("[]")
+			return nil
+		}
+		buffer.WriteString("[\n")
+		for i, item := range value {
+			buffer.WriteString(indent + "  ")
+			err := writeFormattedJSON(buffer, item, indent+"  ", objectKeyOrder)
+			if err != nil {
+				return err
+			}
+			if i < len(value)-1 {
+				buffer.WriteByte(',')
+			}
+			buffer.WriteByte('\n')
+		}
+		buffer.WriteString(indent + "]")
+	case string:
+		writeJSONString(buffer, value)
+	case json.Number:
+		buffer.WriteString(value.String())
+	case bool:
+		if value {
+			buffer.WriteString("true")
+		} else {
+			buffer.WriteString("false")
+		}
+	case nil:
+		buffer.WriteString("null")
+	default:
+		return E.New("unexpected JSON value: ", value)
+	}
+	return nil
+}
+
+// compareKeys orders keys in keyOrder first, then the others alphabetically.
+func compareKeys(a, b string, keyOrder []string) int {
+	aIndex, bIndex := slices.Index(keyOrder, a), slices.Index(keyOrder, b)
+	switch {
+	case aIndex >= 0 && bIndex >= 0:
+		return aIndex - bIndex
+	case aIndex >= 0:
+		return -1
+	case bIndex >= 0:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+func writeJSONString(buffer *bytes.Buffer, value string) {
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(value)
+	// Encode appends a newline
+	buffer.Truncate(buffer.Len() - 1)
+}
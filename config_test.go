@@ -0,0 +1,62 @@
+package libbox
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFormatConfigRoundTrip(t *testing.T) {
+	for _, testCase := range []struct {
+		name    string
+		content string
+	}{
+		{"v5", `{
+	// comments and key order are not preserved
+	"outbounds": [{"tag": "direct", "protocol": "freedom"}, {"protocol": "blackhole", "tag": "block"}],
+	"router": {
+		"domainStrategy": "IpIfNonMatch",
+		"rule": [{"tag": "block", "domain": [{"type": "Plain", "value": "example.com"}]}]
+	},
+	"dns": {"nameServer": [{"address": {"address": "1.1.1.1", "port": 53}}]},
+	"log": {"error": {"level": "Warning", "type": "Console"}}
+}`},
+		{"v4", `{
+	"outbounds": [{"protocol": "freedom", "tag": "direct", "settings": {"domainStrategy": "UseIP"}}],
+	"routing": {"rules": [{"type": "field", "port": "53,443", "outboundTag": "direct"}]},
+	"log": {"loglevel": "warning"}
+}`},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, original, err := parseConfig(testCase.content, ConfigFormatAuto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			formatted, err := FormatConfig(testCase.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, reparsed, err := parseConfig(formatted.Value, ConfigFormatAuto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(original, reparsed) {
+				t.Fatalf("formatted config differs:\n%s", formatted.Value)
+			}
+			formattedAgain, err := FormatConfig(formatted.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if formattedAgain.Value != formatted.Value {
+				t.Fatalf("format is not stable:\n%s\n%s", formatted.Value, formattedAgain.Value)
+			}
+		})
+	}
+}
+
+func TestFormatConfigTrailingData(t *testing.T) {
+	_, err := FormatConfig(`{"outbounds": []} {"log": {}}`)
+	if err == nil {
+		t.Fatal("expected error for trailing data")
+	}
+}
@@ -0,0 +1,69 @@
+package libbox
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+
+	F "github.com/sagernet/sing/common/format"
+	appDNS "github.com/v2fly/v2ray-core/v5/app/dns"
+	"github.com/v2fly/v2ray-core/v5/common/log"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+)
+
+// flushV2RayDNSCache drops the records cached by all V2Ray name servers.
+// app/dns does not expose its cache, so the `ips` map of each server is replaced by reflection,
+// and a warning is logged if a V2Ray update has changed the fields.
+func flushV2RayDNSCache(client dns.Client) {
+	dnsApp, isDNSApp := client.(*appDNS.DNS)
+	if !isDNSApp {
+		return
+	}
+	clients := exportedField(reflect.ValueOf(dnsApp).Elem(), "clients")
+	if !clients.IsValid() || clients.Kind() != reflect.Slice {
+		warnDNSCacheField("DNS.clients")
+		return
+	}
+	for i := 0; i < clients.Len(); i++ {
+		server := exportedField(clients.Index(i).Elem(), "server")
+		if !server.IsValid() {
+			warnDNSCacheField("Client.server")
+			return
+		}
+		if server.IsNil() {
+			continue
+		}
+		server = server.Elem()
+		// the local and fakedns servers have no cache and no lock
+		locker, isLocker := server.Interface().(sync.Locker)
+		if !isLocker || server.Kind() != reflect.Pointer {
+			continue
+		}
+		cache := exportedField(server.Elem(), "ips")
+		if !cache.IsValid() || cache.Kind() != reflect.Map {
+			warnDNSCacheField(server.Type().String() + ".ips")
+			continue
+		}
+		locker.Lock()
+		cache.Set(reflect.MakeMap(cache.Type()))
+		locker.Unlock()
+	}
+}
+
+func warnDNSCacheField(name string) {
+	log.Record(&log.GeneralMessage{
+		Severity: log.Severity_Warning,
+		Content:  F.ToString("flush dns cache: field ", name, " not found"),
+	})
+}
+
+func exportedField(value reflect.Value, name string) reflect.Value {
+	if value.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	field := value.FieldByName(name)
+	if !field.IsValid() || !field.CanAddr() {
+		return reflect.Value{}
+	}
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+}
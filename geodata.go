@@ -0,0 +1,219 @@
+package libbox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/v2fly/v2ray-core/v5/app/router"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	"github.com/v2fly/v2ray-core/v5/common/platform"
+	"github.com/v2fly/v2ray-core/v5/common/platform/filesystem"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/geodata"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ListGeoCategories lists the categories of a geosite or geoip file such as `geosite.dat`,
+// resolved like V2Ray does: from the working path first, then the bundled assets.
+// The file is `geosite.dat` if empty.
+func ListGeoCategories(fileName string) (StringIterator, error) {
+	if fileName == "" {
+		fileName = "geosite.dat"
+	}
+	var categories []string
+	err := scanGeodata(fileName, func(entry []byte) error {
+		category, err := geodataEntryCode(entry)
+		if err != nil {
+			return err
+		}
+		categories = append(categories, strings.ToLower(category))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newIterator(categories), nil
+}
+
+// MatchGeosite reports whether the domain belongs to the geosite category,
+// which may have attributes such as `google@ads`. The file is `geosite.dat` if empty.
+func MatchGeosite(fileName string, category string, domain string) (bool, error) {
+	if fileName == "" {
+		fileName = "geosite.dat"
+	}
+	loader := common.Must1(geodata.GetGeoDataLoader("memconservative"))
+	domains, err := loader.LoadGeoSiteWithAttr(fileName, category)
+	if err != nil {
+		return false, err
+	}
+	return matchGeositeDomains(domains, domain)
+}
+
+// MatchGeoIP reports whether the address belongs to the geoip category. The file is `geoip.dat` if empty.
+func MatchGeoIP(fileName string, category string, address string) (bool, error) {
+	if fileName == "" {
+		fileName = "geoip.dat"
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false, E.New("invalid IP address: ", address)
+	}
+	loader := common.Must1(geodata.GetGeoDataLoader("memconservative"))
+	cidrs, err := loader.LoadIP(fileName, category)
+	if err != nil {
+		return false, err
+	}
+	return matchGeoIPCIDRs(cidrs, ip)
+}
+
+// LookupGeosite returns all geosite categories the domain belongs to, decoding one category at a time.
+func LookupGeosite(fileName string, domain string) (StringIterator, error) {
+	if fileName == "" {
+		fileName = "geosite.dat"
+	}
+	var categories []string
+	err := scanGeodata(fileName, func(entry []byte) error {
+		var site routercommon.GeoSite
+		err := proto.Unmarshal(entry, &site)
+		if err != nil {
+			return err
+		}
+		matched, err := matchGeositeDomains(site.Domain, domain)
+		if err != nil {
+			return E.Cause(err, "geosite ", site.CountryCode)
+		}
+		if matched {
+			categories = append(categories, strings.ToLower(site.CountryCode))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newIterator(categories), nil
+}
+
+// LookupGeoIP returns all geoip categories the address belongs to, decoding one category at a time.
+func LookupGeoIP(fileName string, address string) (StringIterator, error) {
+	if fileName == "" {
+		fileName = "geoip.dat"
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, E.New("invalid IP address: ", address)
+	}
+	var categories []string
+	err := scanGeodata(fileName, func(entry []byte) error {
+		var geoip routercommon.GeoIP
+		err := proto.Unmarshal(entry, &geoip)
+		if err != nil {
+			return err
+		}
+		matched, err := matchGeoIPCIDRs(geoip.Cidr, ip)
+		if err != nil {
+			return E.Cause(err, "geoip ", geoip.CountryCode)
+		}
+		if matched {
+			categories = append(categories, strings.ToLower(geoip.CountryCode))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newIterator(categories), nil
+}
+
+func matchGeositeDomains(domains []*routercommon.Domain, domain string) (bool, error) {
+	matcher, err := router.NewDomainMatcher("linear", domains)
+	if err != nil {
+		return false, err
+	}
+	return matcher.Match(strings.ToLower(domain)), nil
+}
+
+func matchGeoIPCIDRs(cidrs []*routercommon.CIDR, ip net.IP) (bool, error) {
+	var matcher router.GeoIPMatcher
+	err := matcher.Init(cidrs)
+	if err != nil {
+		return false, err
+	}
+	// the matcher selects the address family by length
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return matcher.Match(ip), nil
+}
+
+// geodataMaxEntrySize bounds a single category well below the memory limit of the iOS network extension,
+// the largest categories of the v2fly files are much smaller.
+const geodataMaxEntrySize = 8 * 1024 * 1024
+
+// scanGeodata reads the entries of a GeoSiteList or GeoIPList one by one,
+// so that only one category is in memory at a time. The memconservative loader can not be used here,
+// since it only looks up a known category and caches every category it has decoded.
+func scanGeodata(fileName string, handler func(entry []byte) error) error {
+	file, err := filesystem.NewFileSeeker(platform.GetAssetLocation(fileName))
+	if err != nil {
+		return E.Cause(err, "open ", fileName)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		tag, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return E.Cause(err, "read ", fileName)
+		}
+		if protowire.Number(tag>>3) != 1 || protowire.Type(tag&7) != protowire.BytesType {
+			return E.New("invalid geodata file: ", fileName)
+		}
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return E.Cause(err, "read ", fileName)
+		}
+		if length > geodataMaxEntrySize {
+			return E.New("invalid geodata file: ", fileName, ": entry of ", length, " bytes")
+		}
+		entry := make([]byte, length)
+		_, err = io.ReadFull(reader, entry)
+		if err != nil {
+			return E.Cause(err, "read ", fileName)
+		}
+		err = handler(entry)
+		if err != nil {
+			return E.Cause(err, "decode ", fileName)
+		}
+	}
+}
+
+// geodataEntryCode returns the country_code field, the first field of both GeoSite and GeoIP.
+func geodataEntryCode(entry []byte) (string, error) {
+	for len(entry) > 0 {
+		number, fieldType, n := protowire.ConsumeTag(entry)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		entry = entry[n:]
+		if number == 1 && fieldType == protowire.BytesType {
+			code, n := protowire.ConsumeBytes(entry)
+			if n < 0 {
+				return "", protowire.ParseError(n)
+			}
+			return string(code), nil
+		}
+		n = protowire.ConsumeFieldValue(number, fieldType, entry)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		entry = entry[n:]
+	}
+	return "", E.New("missing country code")
+}
@@ -8,7 +8,9 @@ require (
 	github.com/sagernet/sing-tun v0.6.0-beta.7
 	github.com/sagernet/sing-vmess v0.1.12
 	github.com/v2fly/v2ray-core/v5 v5.23.1-0.20241227015531-f0a87b9c09aa
+	golang.org/x/net v0.32.0
 	golang.org/x/sys v0.28.0
+	google.golang.org/protobuf v1.35.2
 )
 
 require (
@@ -73,14 +75,12 @@ require (
 	golang.org/x/crypto v0.30.0 // indirect
 	golang.org/x/exp v0.0.0-20240719175910-8a7402abbf56 // indirect
 	golang.org/x/mod v0.20.0 // indirect
-	golang.org/x/net v0.32.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 	golang.org/x/time v0.7.0 // indirect
 	golang.org/x/tools v0.24.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240903143218-8af14fe29dc1 // indirect
 	google.golang.org/grpc v1.68.1 // indirect
-	google.golang.org/protobuf v1.35.2 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	gvisor.dev/gvisor v0.0.0-20231020174304-b8a429915ff1 // indirect
 	lukechampine.com/blake3 v1.3.0 // indirect
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -14,17 +15,21 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/sagernet/sing/common"
-	"github.com/sagernet/sing/common/bufio"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	sHTTP "github.com/sagernet/sing/protocol/http"
 	"github.com/sagernet/sing/protocol/socks"
 	"github.com/sagernet/sing/protocol/socks/socks5"
+	"github.com/v2fly/v2ray-core/v5"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
 )
 
 type HTTPClient interface {
@@ -32,7 +37,16 @@ type HTTPClient interface {
 	ModernTLS()
 	PinnedTLS12()
 	PinnedSHA256(sumHex string)
+	AddPinnedSPKI(pin string) error
+	PinOnly()
+	SetRootCAPEM(certificatePEM string) error
 	TrySocks5(port int32)
+	SetTimeout(timeoutMillis int64)
+	SetMaxRedirects(maxRedirects int32)
+	DisableRedirect()
+	HTTPProxy(server string, port int32, username string, password string)
+	Socks5Proxy(server string, port int32, username string, password string)
+	UseService(service *Service, outboundTag string)
 	KeepAlive()
 	NewRequest() HTTPRequest
 	Close()
@@ -46,12 +60,25 @@ type HTTPRequest interface {
 	SetContentString(content string)
 	RandomUserAgent()
 	SetUserAgent(userAgent string)
+	SetIfNoneMatch(etag string)
+	SetIfModifiedSince(lastModified string)
+	UseCache()
 	Execute() (HTTPResponse, error)
+	Download(path string, handler HTTPProgressHandler) error
 }
 
 type HTTPResponse interface {
+	GetStatusCode() int32
+	GetHeader(key string) string
+	GetHeaderKeys() StringIterator
+	GetFinalURL() string
+	GetETag() string
+	GetLastModified() string
+	IsNotModified() bool
+	GetSubscriptionInfo() *SubscriptionInfo
 	GetContent() (*StringBox, error)
 	WriteTo(path string) error
+	WriteToWithProgress(path string, handler HTTPProgressHandler) error
 }
 
 var (
@@ -61,9 +88,11 @@ var (
 )
 
 type httpClient struct {
-	tls       tls.Config
-	client    http.Client
-	transport http.Transport
+	tls             tls.Config
+	client          http.Client
+	transport       http.Transport
+	disableRedirect bool
+	spkiPins        [][]byte
 }
 
 func NewHTTPClient() HTTPClient {
@@ -108,6 +137,63 @@ func (c *httpClient) PinnedSHA256(sumHex string) {
 	}
 }
 
+// AddPinnedSPKI adds a SHA256 hash of a certificate public key, in base64 optionally prefixed
+// with `sha256/`, or in hex. Connections are accepted if any certificate in the chain matches any pin,
+// so backup pins survive certificate renewals and key rotations.
+func (c *httpClient) AddPinnedSPKI(pin string) error {
+	pin = strings.TrimPrefix(pin, "sha256/")
+	pinSum, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(pinSum) != sha256.Size {
+		pinSum, err = hex.DecodeString(pin)
+	}
+	if err != nil || len(pinSum) != sha256.Size {
+		return E.New("invalid SPKI pin: ", pin)
+	}
+	c.spkiPins = append(c.spkiPins, pinSum)
+	c.tls.VerifyConnection = c.verifySPKIPins
+	return nil
+}
+
+// PinOnly skips certificate chain verification for self-signed servers,
+// the leaf certificate must match a pin added by AddPinnedSPKI instead.
+func (c *httpClient) PinOnly() {
+	c.tls.InsecureSkipVerify = true
+	c.tls.VerifyConnection = c.verifySPKIPins
+}
+
+func (c *httpClient) verifySPKIPins(state tls.ConnectionState) error {
+	if len(c.spkiPins) == 0 {
+		return E.New("missing SPKI pins")
+	}
+	var certificates []*x509.Certificate
+	if c.tls.InsecureSkipVerify {
+		// only the leaf is proven by the handshake without a verified chain
+		certificates = state.PeerCertificates[:min(1, len(state.PeerCertificates))]
+	} else {
+		for _, chain := range state.VerifiedChains {
+			certificates = append(certificates, chain...)
+		}
+	}
+	for _, certificate := range certificates {
+		spkiSum := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		if common.Any(c.spkiPins, func(it []byte) bool {
+			return bytes.Equal(it, spkiSum[:])
+		}) {
+			return nil
+		}
+	}
+	return E.New("SPKI pin mismatch")
+}
+
+func (c *httpClient) SetRootCAPEM(certificatePEM string) error {
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM([]byte(certificatePEM)) {
+		return E.New("invalid root CA PEM")
+	}
+	c.tls.RootCAs = certPool
+	return nil
+}
+
 func (c *httpClient) TrySocks5(port int32) {
 	dialer := new(net.Dialer)
 	c.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -127,6 +213,73 @@ func (c *httpClient) TrySocks5(port int32) {
 	}
 }
 
+func (c *httpClient) SetTimeout(timeoutMillis int64) {
+	c.client.Timeout = time.Duration(timeoutMillis) * time.Millisecond
+}
+
+func (c *httpClient) SetMaxRedirects(maxRedirects int32) {
+	if maxRedirects <= 0 {
+		c.DisableRedirect()
+		return
+	}
+	c.disableRedirect = false
+	c.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= int(maxRedirects) {
+			return E.New("stopped after ", maxRedirects, " redirects")
+		}
+		return nil
+	}
+}
+
+// DisableRedirect returns redirect responses as is instead of following them.
+func (c *httpClient) DisableRedirect() {
+	c.disableRedirect = true
+	c.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+}
+
+// HTTPProxy tunnels all requests through the HTTP proxy server with CONNECT.
+func (c *httpClient) HTTPProxy(server string, port int32, username string, password string) {
+	c.useDialer(sHTTP.NewClient(sHTTP.Options{
+		Dialer:   N.SystemDialer,
+		Server:   M.ParseSocksaddrHostPort(server, uint16(port)),
+		Username: username,
+		Password: password,
+	}))
+}
+
+func (c *httpClient) Socks5Proxy(server string, port int32, username string, password string) {
+	c.useDialer(socks.NewClient(N.SystemDialer, M.ParseSocksaddrHostPort(server, uint16(port)), socks.Version5, username, password))
+}
+
+// UseService dials through the V2Ray instance of the running service without a local inbound,
+// routed by its rules, or to the outbound with the tag if not empty.
+func (c *httpClient) UseService(service *Service, outboundTag string) {
+	c.transport.Proxy = nil
+	c.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if service.ctx.Err() != nil {
+			return nil, E.New("service closed")
+		}
+		destination, err := v2rayNet.ParseDestination("tcp:" + addr)
+		if err != nil {
+			return nil, err
+		}
+		dialCtx := service.ctx
+		if outboundTag != "" {
+			dialCtx = session.SetForcedOutboundTagToContext(dialCtx, outboundTag)
+		}
+		return core.Dial(dialCtx, service.instance, destination)
+	}
+}
+
+func (c *httpClient) useDialer(dialer N.Dialer) {
+	c.transport.Proxy = nil
+	c.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, M.ParseSocksaddr(addr))
+	}
+}
+
 func (c *httpClient) KeepAlive() {
 	c.transport.DisableKeepAlives = false
 }
@@ -146,7 +299,8 @@ func (c *httpClient) Close() {
 
 type httpRequest struct {
 	*httpClient
-	request http.Request
+	request  http.Request
+	useCache bool
 }
 
 func (r *httpRequest) SetURL(link string) (err error) {
@@ -178,6 +332,20 @@ func (r *httpRequest) SetUserAgent(userAgent string) {
 	r.request.Header.Set("User-Agent", userAgent)
 }
 
+func (r *httpRequest) SetIfNoneMatch(etag string) {
+	r.request.Header.Set("If-None-Match", etag)
+}
+
+func (r *httpRequest) SetIfModifiedSince(lastModified string) {
+	r.request.Header.Set("If-Modified-Since", lastModified)
+}
+
+// UseCache keeps the content of the URL under the working directory and revalidates it with
+// ETag or Last-Modified, an unchanged response reports IsNotModified with the cached content.
+func (r *httpRequest) UseCache() {
+	r.useCache = true
+}
+
 func (r *httpRequest) SetContent(content []byte) {
 	buffer := bytes.Buffer{}
 	buffer.Write(content)
@@ -190,17 +358,39 @@ func (r *httpRequest) SetContentString(content string) {
 }
 
 func (r *httpRequest) Execute() (HTTPResponse, error) {
+	var cacheEntry *httpCacheEntry
+	if r.useCache {
+		cacheEntry = r.applyHTTPCache()
+	}
 	response, err := r.client.Do(&r.request)
 	if err != nil {
 		return nil, err
 	}
 	httpResp := &httpResponse{Response: response}
-	if response.StatusCode != http.StatusOK {
+	switch {
+	case response.StatusCode == http.StatusOK, response.StatusCode == http.StatusNotModified:
+	case r.disableRedirect && isRedirect(response.StatusCode):
+	default:
 		return nil, errors.New(httpResp.errorString())
 	}
+	if r.useCache {
+		err = r.updateHTTPCache(httpResp, cacheEntry)
+		if err != nil {
+			return nil, E.Cause(err, "read response")
+		}
+	}
 	return httpResp, nil
 }
 
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
 type httpResponse struct {
 	*http.Response
 
@@ -217,6 +407,45 @@ func (h *httpResponse) errorString() string {
 	return fmt.Sprint("HTTP ", h.Status, ": ", content)
 }
 
+func (h *httpResponse) GetStatusCode() int32 {
+	return int32(h.StatusCode)
+}
+
+func (h *httpResponse) GetHeader(key string) string {
+	return h.Header.Get(key)
+}
+
+func (h *httpResponse) GetHeaderKeys() StringIterator {
+	keys := make([]string, 0, len(h.Header))
+	for key := range h.Header {
+		keys = append(keys, key)
+	}
+	return newIterator(keys)
+}
+
+// GetFinalURL returns the URL of the last request after following redirects.
+func (h *httpResponse) GetFinalURL() string {
+	return h.Request.URL.String()
+}
+
+func (h *httpResponse) GetETag() string {
+	return h.Header.Get("ETag")
+}
+
+func (h *httpResponse) GetLastModified() string {
+	return h.Header.Get("Last-Modified")
+}
+
+// IsNotModified reports a 304 response, the content is unchanged since the ETag or Last-Modified of the request.
+func (h *httpResponse) IsNotModified() bool {
+	return h.StatusCode == http.StatusNotModified
+}
+
+// GetSubscriptionInfo returns nil if the provider sent no subscription headers.
+func (h *httpResponse) GetSubscriptionInfo() *SubscriptionInfo {
+	return parseSubscriptionInfo(h.Header)
+}
+
 func (h *httpResponse) GetContent() (*StringBox, error) {
 	h.getContentOnce.Do(func() {
 		defer h.Body.Close()
@@ -229,11 +458,5 @@ func (h *httpResponse) GetContent() (*StringBox, error) {
 }
 
 func (h *httpResponse) WriteTo(path string) error {
-	defer h.Body.Close()
-	file, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	return common.Error(bufio.Copy(file, h.Body))
+	return h.WriteToWithProgress(path, nil)
 }
@@ -0,0 +1,213 @@
+package libbox
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	F "github.com/sagernet/sing/common/format"
+	"github.com/sagernet/sing/common/varbin"
+	"github.com/v2fly/v2ray-core/v5/common/log"
+)
+
+type httpCacheEntry struct {
+	URL          string
+	ETag         string
+	LastModified string
+	Content      []byte
+}
+
+const (
+	// httpCacheMaxEntrySize is the largest response body that is cached.
+	httpCacheMaxEntrySize = 4 * 1024 * 1024
+	// httpCacheMaxSize is the total size of cache entries, least recently used entries are evicted above it.
+	httpCacheMaxSize = 32 * 1024 * 1024
+)
+
+func httpCacheDir() string {
+	return filepath.Join(sWorkingPath, "http_cache")
+}
+
+func httpCachePath(link string) string {
+	linkSum := sha256.Sum256([]byte(link))
+	return filepath.Join(httpCacheDir(), hex.EncodeToString(linkSum[:16]))
+}
+
+// httpCacheKey is the URL without credentials, which are not written to the cache.
+func httpCacheKey(requestURL *url.URL) string {
+	if requestURL.User == nil {
+		return requestURL.String()
+	}
+	keyURL := *requestURL
+	keyURL.User = nil
+	return keyURL.String()
+}
+
+func loadHTTPCache(link string) (*httpCacheEntry, error) {
+	data, err := os.ReadFile(httpCachePath(link))
+	if err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(data)
+	var entry httpCacheEntry
+	entry.URL, err = varbin.ReadValue[string](reader, binary.BigEndian)
+	if err != nil {
+		return nil, err
+	}
+	if entry.URL != link {
+		return nil, os.ErrNotExist
+	}
+	entry.ETag, err = varbin.ReadValue[string](reader, binary.BigEndian)
+	if err != nil {
+		return nil, err
+	}
+	entry.LastModified, err = varbin.ReadValue[string](reader, binary.BigEndian)
+	if err != nil {
+		return nil, err
+	}
+	entry.Content, err = io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	// the modification time orders entries for eviction
+	nowTime := time.Now()
+	os.Chtimes(httpCachePath(link), nowTime, nowTime)
+	return &entry, nil
+}
+
+func saveHTTPCache(entry *httpCacheEntry) error {
+	cachePath := httpCachePath(entry.URL)
+	err := os.MkdirAll(filepath.Dir(cachePath), 0o755)
+	if err != nil {
+		return err
+	}
+	tempPath := cachePath + ".tmp"
+	cacheFile, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(cacheFile)
+	varbin.Write(writer, binary.BigEndian, entry.URL)
+	varbin.Write(writer, binary.BigEndian, entry.ETag)
+	varbin.Write(writer, binary.BigEndian, entry.LastModified)
+	writer.Write(entry.Content)
+	err = writer.Flush()
+	cacheFile.Close()
+	if err == nil {
+		err = os.Rename(tempPath, cachePath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return evictHTTPCache()
+}
+
+func evictHTTPCache() error {
+	dirEntries, err := os.ReadDir(httpCacheDir())
+	if err != nil {
+		return err
+	}
+	var (
+		cacheFiles []os.FileInfo
+		totalSize  int64
+	)
+	for _, dirEntry := range dirEntries {
+		fileInfo, err := dirEntry.Info()
+		if err != nil || !fileInfo.Mode().IsRegular() {
+			continue
+		}
+		cacheFiles = append(cacheFiles, fileInfo)
+		totalSize += fileInfo.Size()
+	}
+	sort.Slice(cacheFiles, func(i, j int) bool {
+		return cacheFiles[i].ModTime().Before(cacheFiles[j].ModTime())
+	})
+	for _, fileInfo := range cacheFiles {
+		if totalSize <= httpCacheMaxSize {
+			break
+		}
+		err = os.Remove(filepath.Join(httpCacheDir(), fileInfo.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		totalSize -= fileInfo.Size()
+	}
+	return nil
+}
+
+// applyHTTPCache sets conditional headers from the cache entry of the request URL.
+// If the caller has set its own, no entry is returned, so that 304 responses are passed to the caller.
+func (r *httpRequest) applyHTTPCache() *httpCacheEntry {
+	if r.request.Header.Get("If-None-Match") != "" || r.request.Header.Get("If-Modified-Since") != "" {
+		return nil
+	}
+	entry, err := loadHTTPCache(httpCacheKey(r.request.URL))
+	if err != nil {
+		return nil
+	}
+	if entry.ETag != "" {
+		r.request.Header.Set("If-None-Match", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		r.request.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+	return entry
+}
+
+// updateHTTPCache replaces the response body with the cached content for 304 responses,
+// and stores 200 responses with a validator and a body of at most httpCacheMaxEntrySize.
+// Only errors reading the response body are returned, failing to save the cache is logged.
+func (r *httpRequest) updateHTTPCache(response *httpResponse, entry *httpCacheEntry) error {
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		if entry == nil {
+			return nil
+		}
+		response.Body.Close()
+		response.Body = io.NopCloser(bytes.NewReader(entry.Content))
+		response.ContentLength = int64(len(entry.Content))
+	case http.StatusOK:
+		newEntry := &httpCacheEntry{
+			URL:          httpCacheKey(r.request.URL),
+			ETag:         response.Header.Get("ETag"),
+			LastModified: response.Header.Get("Last-Modified"),
+		}
+		if newEntry.ETag == "" && newEntry.LastModified == "" || response.ContentLength > httpCacheMaxEntrySize {
+			return nil
+		}
+		content, err := io.ReadAll(io.LimitReader(response.Body, httpCacheMaxEntrySize+1))
+		if err != nil {
+			response.Body.Close()
+			return err
+		}
+		if len(content) > httpCacheMaxEntrySize {
+			// too large to cache, the caller reads the rest from the connection
+			response.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(content), response.Body), response.Body}
+			return nil
+		}
+		response.Body.Close()
+		newEntry.Content = content
+		response.Body = io.NopCloser(bytes.NewReader(content))
+		err = saveHTTPCache(newEntry)
+		if err != nil {
+			log.Record(&log.GeneralMessage{
+				Severity: log.Severity_Warning,
+				Content:  F.ToString("save http cache for ", newEntry.URL, ": ", err),
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package libbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+)
+
+type HTTPProgressHandler interface {
+	// OnProgress reports downloaded bytes, total is -1 if unknown.
+	OnProgress(done int64, total int64)
+}
+
+const progressInterval = 100 * time.Millisecond
+
+// Download writes the response body to path, resuming the partial download of an
+// earlier failed attempt for the same URL with an HTTP Range request if possible.
+func (r *httpRequest) Download(path string, handler HTTPProgressHandler) error {
+	partPath := downloadPartPath(r.request.URL.String())
+	validatorPath := partPath + ".validator"
+	// downloads of the same URL share the partial file, so they run one at a time
+	unlock := lockDownload(partPath)
+	defer unlock()
+	response, offset, err := r.downloadResponse(partPath, validatorPath)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	validator := response.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = response.Header.Get("Last-Modified")
+	}
+	if validator != "" {
+		err = os.WriteFile(validatorPath, []byte(validator), 0o644)
+	} else {
+		err = os.Remove(validatorPath)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fileFlag := os.O_CREATE | os.O_WRONLY
+	if offset > 0 {
+		fileFlag |= os.O_APPEND
+	} else {
+		fileFlag |= os.O_TRUNC
+	}
+	partFile, err := os.OpenFile(partPath, fileFlag, 0o644)
+	if err != nil {
+		return err
+	}
+	err = copyWithProgress(partFile, response.Body, offset, response.ContentLength, handler)
+	partFile.Close()
+	if err != nil {
+		return E.Cause(err, "download ", r.request.URL)
+	}
+	os.Remove(validatorPath)
+	return moveFile(partPath, path)
+}
+
+// downloadResponse requests the rest of the partial file if any, or the whole file
+// if the server rejects the range, e.g. when the partial file is already complete.
+func (r *httpRequest) downloadResponse(partPath string, validatorPath string) (*http.Response, int64, error) {
+	var offset int64
+	if partInfo, err := os.Stat(partPath); err == nil && partInfo.Size() > 0 {
+		validator, _ := os.ReadFile(validatorPath)
+		if len(validator) > 0 {
+			offset = partInfo.Size()
+			r.request.Header.Set("Range", F.ToString("bytes=", offset, "-"))
+			r.request.Header.Set("If-Range", string(validator))
+		}
+	}
+	response, err := r.client.Do(&r.request)
+	r.request.Header.Del("Range")
+	r.request.Header.Del("If-Range")
+	if err != nil {
+		return nil, 0, err
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response, 0, nil
+	case http.StatusPartialContent:
+		contentRange := response.Header.Get("Content-Range")
+		if offset == 0 || !strings.HasPrefix(contentRange, F.ToString("bytes ", offset, "-")) {
+			response.Body.Close()
+			return nil, 0, E.New("unexpected content range: ", contentRange)
+		}
+		return response, offset, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		response.Body.Close()
+		if offset == 0 {
+			break
+		}
+		os.Remove(validatorPath)
+		err = os.Remove(partPath)
+		if err != nil {
+			return nil, 0, err
+		}
+		return r.downloadResponse(partPath, validatorPath)
+	}
+	defer response.Body.Close()
+	return nil, 0, errors.New((&httpResponse{Response: response}).errorString())
+}
+
+var (
+	downloadAccess sync.Mutex
+	downloadLocks  = make(map[string]*downloadLock)
+)
+
+type downloadLock struct {
+	sync.Mutex
+	references int
+}
+
+func lockDownload(partPath string) (unlock func()) {
+	downloadAccess.Lock()
+	lock := downloadLocks[partPath]
+	if lock == nil {
+		lock = new(downloadLock)
+		downloadLocks[partPath] = lock
+	}
+	lock.references++
+	downloadAccess.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		downloadAccess.Lock()
+		lock.references--
+		if lock.references == 0 {
+			delete(downloadLocks, partPath)
+		}
+		downloadAccess.Unlock()
+	}
+}
+
+func (h *httpResponse) WriteToWithProgress(path string, handler HTTPProgressHandler) error {
+	defer h.Body.Close()
+	tempFile, err := os.CreateTemp(tempDir(), "download-*.tmp")
+	if err != nil {
+		return err
+	}
+	err = tempFile.Chmod(0o644)
+	if err == nil {
+		err = copyWithProgress(tempFile, h.Body, 0, h.ContentLength, handler)
+	}
+	tempFile.Close()
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return moveFile(tempFile.Name(), path)
+}
+
+func copyWithProgress(destination io.Writer, source io.Reader, offset int64, contentLength int64, handler HTTPProgressHandler) error {
+	if handler == nil {
+		_, err := bufio.Copy(destination, source)
+		return err
+	}
+	total := int64(-1)
+	if contentLength >= 0 {
+		total = offset + contentLength
+	}
+	progress := &progressWriter{handler: handler, done: offset, total: total}
+	_, err := bufio.Copy(io.MultiWriter(destination, progress), source)
+	if err == nil {
+		handler.OnProgress(progress.done, total)
+	}
+	return err
+}
+
+type progressWriter struct {
+	handler    HTTPProgressHandler
+	done       int64
+	total      int64
+	lastReport time.Time
+}
+
+func (w *progressWriter) Write(p []byte) (n int, err error) {
+	w.done += int64(len(p))
+	if nowTime := time.Now(); nowTime.Sub(w.lastReport) >= progressInterval {
+		w.lastReport = nowTime
+		w.handler.OnProgress(w.done, w.total)
+	}
+	return len(p), nil
+}
+
+func tempDir() string {
+	if sTempPath != "" {
+		return sTempPath
+	}
+	return os.TempDir()
+}
+
+func downloadPartPath(link string) string {
+	linkSum := sha256.Sum256([]byte(link))
+	return filepath.Join(tempDir(), "download-"+hex.EncodeToString(linkSum[:8])+".part")
+}
+
+// moveFile renames from to path, falling back to a copy next to path
+// when the temp directory is on another file system.
+func moveFile(from string, path string) error {
+	err := os.Rename(from, path)
+	if err == nil {
+		return nil
+	}
+	defer os.Remove(from)
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	tempPath := path + ".tmp"
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	_, err = bufio.Copy(tempFile, source)
+	tempFile.Close()
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+	}
+	return err
+}
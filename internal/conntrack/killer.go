@@ -11,6 +11,7 @@ import (
 var (
 	KillerEnabled   bool
 	MemoryLimit     uint64
+	KillerHandler   func()
 	killerLastCheck time.Time
 )
 
@@ -25,6 +26,9 @@ func KillerCheck() error {
 	killerLastCheck = nowTime
 	if memory.Total() > MemoryLimit {
 		Close()
+		if KillerHandler != nil {
+			KillerHandler()
+		}
 		go func() {
 			time.Sleep(time.Second)
 			runtimeDebug.FreeOSMemory()
@@ -39,9 +39,11 @@ func Close() {
 	}
 	connAccess.Lock()
 	defer connAccess.Unlock()
-	for element := openConnection.Front(); element != nil; element = element.Next() {
-		common.Close(element.Value)
-		element.Value = nil
+	for _, closerList := range []*list.List[io.Closer]{&openConnection, &openSessions} {
+		for element := closerList.Front(); element != nil; element = element.Next() {
+			common.Close(element.Value)
+			element.Value = nil
+		}
+		closerList.Init()
 	}
-	openConnection.Init()
 }
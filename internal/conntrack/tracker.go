@@ -0,0 +1,60 @@
+package conntrack
+
+import (
+	"io"
+
+	"github.com/sagernet/sing/common/x/list"
+)
+
+// openSessions are inbound flows such as TUN sessions, counted apart from the outbound connections.
+var openSessions list.List[io.Closer]
+
+// Tracker tracks an inbound session, which is closed by Close with the outbound connections.
+type Tracker struct {
+	element *list.Element[io.Closer]
+}
+
+// Track adds the session to the list closed by Close, it returns nil if tracking is disabled.
+func Track(closer io.Closer) *Tracker {
+	if !Enabled {
+		return nil
+	}
+	connAccess.Lock()
+	element := openSessions.PushBack(closer)
+	connAccess.Unlock()
+	return &Tracker{element}
+}
+
+func (t *Tracker) Untrack() {
+	if t == nil || t.element.Value == nil {
+		return
+	}
+	connAccess.Lock()
+	if t.element.Value != nil {
+		openSessions.Remove(t.element)
+		t.element.Value = nil
+	}
+	connAccess.Unlock()
+}
+
+func SessionCount() int {
+	if !Enabled {
+		return 0
+	}
+	connAccess.RLock()
+	defer connAccess.RUnlock()
+	return openSessions.Len()
+}
+
+func Sessions() []io.Closer {
+	if !Enabled {
+		return nil
+	}
+	connAccess.RLock()
+	defer connAccess.RUnlock()
+	sessionList := make([]io.Closer, 0, openSessions.Len())
+	for element := openSessions.Front(); element != nil; element = element.Next() {
+		sessionList = append(sessionList, element.Value)
+	}
+	return sessionList
+}
@@ -1,40 +1,289 @@
 package libbox
 
 import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nekohasekai/libwtf/internal/conntrack"
+
 	"github.com/sagernet/sing/common/control"
 	F "github.com/sagernet/sing/common/format"
 	"github.com/v2fly/v2ray-core/v5/common/log"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
 )
 
 var _ control.InterfaceFinder = (*networkManager)(nil)
 
 type networkManager struct {
 	control.DefaultInterfaceFinder
+	iif            PlatformInterface
+	dnsClient      dns.Client
+	options        networkConfig
+	access         sync.Mutex
 	interfaceName  string
 	interfaceIndex int32
-	iif            PlatformInterface
+	isExpensive    bool
+	isConstrained  bool
+	wifiState      WIFIState
+	wifiRule       *wifiRule
+	resetTimer     *time.Timer
+	resetSequence  int
+	// resetFromName and resetFromIndex are the interface in use before the pending change.
+	resetFromName  string
+	resetFromIndex int32
+	eventListener  networkEventListener
 }
 
-func newNetworkManager(iif PlatformInterface) *networkManager {
-	return &networkManager{iif: iif}
+type networkEventListener interface {
+	emitNetworkEvent(event *NetworkEvent)
+}
+
+func newNetworkManager(iif PlatformInterface, dnsClient dns.Client, options networkConfig) *networkManager {
+	return &networkManager{
+		iif:       iif,
+		dnsClient: dnsClient,
+		options:   options,
+	}
 }
 
 func (m *networkManager) Start() error {
-	return m.iif.StartDefaultInterfaceMonitor(m)
+	err := m.iif.StartDefaultInterfaceMonitor(m)
+	if err != nil {
+		return err
+	}
+	registerInterfaceControl(m)
+	return nil
 }
 
 func (m *networkManager) Close() error {
+	m.access.Lock()
+	if m.resetTimer != nil {
+		m.resetTimer.Stop()
+	}
+	m.access.Unlock()
+	unregisterInterfaceControl(m)
 	return m.iif.CloseDefaultInterfaceMonitor(m)
 }
 
+// Update prefers the interface list of the platform, since the system one
+// is incomplete or unavailable inside sandboxed extensions.
+func (m *networkManager) Update() error {
+	platformInterfaces, err := m.iif.GetInterfaces()
+	if err != nil {
+		return m.DefaultInterfaceFinder.Update()
+	}
+	var interfaces []control.Interface
+	for _, platformInterface := range iteratorToArray[*NetworkInterface](platformInterfaces) {
+		if platformInterface == nil {
+			continue
+		}
+		var addresses []netip.Prefix
+		for _, address := range iteratorToArray[string](platformInterface.Addresses) {
+			prefix, parseErr := parseInterfaceAddress(address)
+			if parseErr != nil {
+				log.Record(&log.GeneralMessage{
+					Severity: log.Severity_Warning,
+					Content:  F.ToString("skipped address ", address, " of interface ", platformInterface.Name, ": ", parseErr),
+				})
+				continue
+			}
+			addresses = append(addresses, prefix)
+		}
+		interfaces = append(interfaces, control.Interface{
+			Index:     int(platformInterface.Index),
+			MTU:       int(platformInterface.MTU),
+			Name:      platformInterface.Name,
+			Flags:     net.Flags(platformInterface.Flags),
+			Addresses: addresses,
+		})
+	}
+	if len(interfaces) == 0 {
+		return m.DefaultInterfaceFinder.Update()
+	}
+	m.UpdateInterfaces(interfaces)
+	return nil
+}
+
+// parseInterfaceAddress accepts a prefix or a bare address, which is treated as a single-address prefix,
+// and drops the IPv6 zone that netip.ParsePrefix rejects.
+func parseInterfaceAddress(address string) (netip.Prefix, error) {
+	if zoneIndex := strings.IndexByte(address, '%'); zoneIndex != -1 {
+		zoneEnd := strings.IndexByte(address[zoneIndex:], '/')
+		if zoneEnd == -1 {
+			address = address[:zoneIndex]
+		} else {
+			address = address[:zoneIndex] + address[zoneIndex+zoneEnd:]
+		}
+	}
+	if !strings.Contains(address, "/") {
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(address)
+}
+
+func (m *networkManager) setEventListener(listener networkEventListener) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	m.eventListener = listener
+}
+
 func (m *networkManager) UpdateDefaultInterface(interfaceName string, interfaceIndex int32, isExpensive bool, isConstrained bool) {
-	_ = m.Update()
-	if interfaceName != m.interfaceName || interfaceIndex != m.interfaceIndex {
-		m.interfaceName = interfaceName
-		m.interfaceIndex = interfaceIndex
+	err := m.Update()
+	if err != nil {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Warning,
+			Content:  F.ToString("update interfaces: ", err),
+		})
+	}
+	var wifiState WIFIState
+	if interfaceName != "" {
+		if state := m.iif.ReadWIFIState(); state != nil {
+			wifiState = *state
+		}
+	}
+	m.access.Lock()
+	defer m.access.Unlock()
+	interfaceChanged := interfaceName != m.interfaceName || interfaceIndex != m.interfaceIndex
+	if !interfaceChanged && isExpensive == m.isExpensive && isConstrained == m.isConstrained && wifiState == m.wifiState {
+		return
+	}
+	m.updateWIFIState(wifiState)
+	previousName, previousIndex := m.interfaceName, m.interfaceIndex
+	m.interfaceName = interfaceName
+	m.interfaceIndex = interfaceIndex
+	m.isExpensive = isExpensive
+	m.isConstrained = isConstrained
+	log.Record(&log.GeneralMessage{
+		Severity: log.Severity_Info,
+		Content:  F.ToString("updated default interface ", interfaceName, ", index ", interfaceIndex, ", expensive ", isExpensive, ", constrained ", isConstrained),
+	})
+	if !interfaceChanged {
+		return
+	}
+	if m.resetTimer == nil {
+		if previousName == "" {
+			return
+		}
+		m.resetFromName, m.resetFromIndex = previousName, previousIndex
+	} else {
+		m.resetTimer.Stop()
+		m.resetTimer = nil
+		m.resetSequence++
+		if interfaceName == m.resetFromName && interfaceIndex == m.resetFromIndex {
+			log.Record(&log.GeneralMessage{
+				Severity: log.Severity_Info,
+				Content:  F.ToString("default interface returned to ", interfaceName, ", skipped reset"),
+			})
+			return
+		}
+	}
+	sequence := m.resetSequence
+	m.resetTimer = time.AfterFunc(m.options.changeDelay(), func() {
+		m.handleInterfaceChange(sequence)
+	})
+}
+
+func (m *networkManager) updateWIFIState(state WIFIState) {
+	if state != m.wifiState && state.SSID != "" {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Info,
+			Content:  F.ToString("connected to WIFI ", state.SSID, " (", state.BSSID, ")"),
+		})
+	}
+	m.wifiState = state
+	var matchedRule *wifiRule
+	for i := range m.options.WIFI {
+		if m.options.WIFI[i].match(state) {
+			matchedRule = &m.options.WIFI[i]
+			break
+		}
+	}
+	if matchedRule == m.wifiRule {
+		return
+	}
+	m.wifiRule = matchedRule
+	if matchedRule != nil {
 		log.Record(&log.GeneralMessage{
 			Severity: log.Severity_Info,
-			Content:  F.ToString("updated default interface ", interfaceName, ", index ", interfaceIndex, ", expensive ", isExpensive, ", constrained ", isConstrained),
+			Content:  F.ToString("switched to WIFI policy for ", state.SSID, ", outbound: ", matchedRule.OutboundTag, ", block all udp: ", matchedRule.BlockAllUDP),
 		})
+	} else {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Info,
+			Content:  "switched back from WIFI policy",
+		})
+	}
+}
+
+func (m *networkManager) networkState() (isExpensive bool, isConstrained bool) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	return m.isExpensive, m.isConstrained
+}
+
+func (m *networkManager) wifiSSID() string {
+	m.access.Lock()
+	defer m.access.Unlock()
+	return m.wifiState.SSID
+}
+
+// policy returns the policy for the current default interface,
+// a matching WIFI rule takes precedence, then the constrained one.
+func (m *networkManager) policy() *networkPolicy {
+	m.access.Lock()
+	wifiRule, isExpensive, isConstrained := m.wifiRule, m.isExpensive, m.isConstrained
+	m.access.Unlock()
+	if wifiRule != nil {
+		return &wifiRule.networkPolicy
+	}
+	if isConstrained && m.options.Constrained != nil {
+		return m.options.Constrained
+	}
+	if isExpensive && m.options.Expensive != nil {
+		return m.options.Expensive
+	}
+	return nil
+}
+
+func (m *networkManager) handleInterfaceChange(sequence int) {
+	m.access.Lock()
+	if sequence != m.resetSequence {
+		// stopped after the timer fired
+		m.access.Unlock()
+		return
+	}
+	m.resetTimer = nil
+	m.resetSequence++
+	if m.interfaceName == m.resetFromName && m.interfaceIndex == m.resetFromIndex {
+		m.access.Unlock()
+		return
+	}
+	event := &NetworkEvent{
+		InterfaceName:    m.interfaceName,
+		InterfaceIndex:   m.interfaceIndex,
+		IsExpensive:      m.isExpensive,
+		IsConstrained:    m.isConstrained,
+		ConnectionsReset: m.options.ResetOnInterfaceChange,
+	}
+	eventListener := m.eventListener
+	m.access.Unlock()
+	if event.ConnectionsReset {
+		conntrack.Close()
+		flushV2RayDNSCache(m.dnsClient)
+		m.iif.ClearDNSCache()
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Info,
+			Content:  F.ToString("reset connections and dns cache for default interface change to ", event.InterfaceName),
+		})
+	}
+	if eventListener != nil {
+		eventListener.emitNetworkEvent(event)
 	}
 }
@@ -0,0 +1,112 @@
+package libbox
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sagernet/sing/common/control"
+	"github.com/v2fly/v2ray-core/v5/transport/internet"
+)
+
+var (
+	registerControlOnce  sync.Once
+	activeNetworkManager atomic.Pointer[networkManager]
+)
+
+// registerInterfaceControl binds sockets created by V2Ray outbounds to the default interface
+// of the running service, so that proxied traffic never loops back into the tun.
+// V2Ray controllers can not be unregistered, so they are registered once and look up the active manager.
+func registerInterfaceControl(manager *networkManager) {
+	registerControlOnce.Do(func() {
+		_ = internet.RegisterDialerController(func(network, address string, fd uintptr) error {
+			if isLocalDestination(address) {
+				return nil
+			}
+			return interfaceControl(network, address, fd)
+		})
+		_ = internet.RegisterListenerController(func(network, address string, fd uintptr) error {
+			if !isOutboundListener(network, address) {
+				return nil
+			}
+			return interfaceControl(network, address, fd)
+		})
+	})
+	activeNetworkManager.Store(manager)
+}
+
+// isOutboundListener reports whether the listener is a packet socket of an outbound,
+// which listens on an unspecified address and an ephemeral port,
+// so that inbounds such as the loopback QUIC hub are not bound.
+func isOutboundListener(network, address string) bool {
+	if !strings.HasPrefix(network, "udp") {
+		return false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || port != "0" {
+		return false
+	}
+	if host == "" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.Unmap().IsUnspecified()
+}
+
+// isLocalDestination reports whether the dial destination is a loopback or link-local address,
+// such as a local socks or http proxy, which is unreachable from the default interface.
+func isLocalDestination(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+func unregisterInterfaceControl(manager *networkManager) {
+	activeNetworkManager.CompareAndSwap(manager, nil)
+}
+
+func interfaceControl(network, address string, fd uintptr) error {
+	manager := activeNetworkManager.Load()
+	if manager == nil {
+		return nil
+	}
+	return manager.autoDetectInterfaceControl(network, address, fd)
+}
+
+func (m *networkManager) autoDetectInterfaceControl(network, address string, fd uintptr) error {
+	if m.iif.UsePlatformAutoDetectInterfaceControl() {
+		return m.iif.AutoDetectInterfaceControl(int32(fd))
+	}
+	m.access.Lock()
+	interfaceName, interfaceIndex := m.interfaceName, m.interfaceIndex
+	m.access.Unlock()
+	if interfaceName == "" {
+		return nil
+	}
+	return control.BindToInterface0(m, rawFileDescriptor(fd), network, address, interfaceName, int(interfaceIndex), false)
+}
+
+type rawFileDescriptor uintptr
+
+func (fd rawFileDescriptor) Control(f func(fd uintptr)) error {
+	f(uintptr(fd))
+	return nil
+}
+
+func (fd rawFileDescriptor) Read(f func(fd uintptr) (done bool)) error {
+	return os.ErrInvalid
+}
+
+func (fd rawFileDescriptor) Write(f func(fd uintptr) (done bool)) error {
+	return os.ErrInvalid
+}
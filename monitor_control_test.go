@@ -0,0 +1,27 @@
+package libbox
+
+import "testing"
+
+func TestIsLocalDestination(t *testing.T) {
+	for _, testCase := range []struct {
+		address string
+		local   bool
+	}{
+		{"127.0.0.1:1080", true},
+		{"127.1.2.3:8080", true},
+		{"[::1]:1080", true},
+		{"[::ffff:127.0.0.1]:1080", true},
+		{"169.254.1.1:80", true},
+		{"[fe80::1%en0]:80", true},
+		{"[ff02::1]:5353", true},
+		{"1.1.1.1:443", false},
+		{"192.168.1.1:1080", false},
+		{"[2001:db8::1]:443", false},
+		{"example.com:443", false},
+		{"localhost:1080", false},
+	} {
+		if local := isLocalDestination(testCase.address); local != testCase.local {
+			t.Errorf("%s: expected %v, got %v", testCase.address, testCase.local, local)
+		}
+	}
+}
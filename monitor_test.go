@@ -0,0 +1,114 @@
+package libbox
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+type fakePlatformInterface struct {
+	PlatformInterface
+	interfaces []*NetworkInterface
+}
+
+func (p *fakePlatformInterface) GetInterfaces() (NetworkInterfaceIterator, error) {
+	if p.interfaces == nil {
+		return nil, os.ErrInvalid
+	}
+	return newIterator(p.interfaces), nil
+}
+
+func (p *fakePlatformInterface) ReadWIFIState() *WIFIState {
+	return nil
+}
+
+type networkEventRecorder struct {
+	access sync.Mutex
+	events []*NetworkEvent
+}
+
+func (r *networkEventRecorder) emitNetworkEvent(event *NetworkEvent) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *networkEventRecorder) interfaceNames() []string {
+	r.access.Lock()
+	defer r.access.Unlock()
+	var names []string
+	for _, event := range r.events {
+		names = append(names, event.InterfaceName)
+	}
+	return names
+}
+
+func TestNetworkManagerDebounce(t *testing.T) {
+	const changeDelay = 20 * time.Millisecond
+	for _, testCase := range []struct {
+		name     string
+		updates  []string
+		expected []string
+	}{
+		{"initial", []string{"en0"}, nil},
+		{"change", []string{"en0", "pdp_ip0"}, []string{"pdp_ip0"}},
+		{"flap", []string{"en0", "", "en0"}, nil},
+		{"flap to other", []string{"en0", "", "pdp_ip0"}, []string{"pdp_ip0"}},
+		{"change and back", []string{"en0", "pdp_ip0", "en0"}, nil},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			manager := newNetworkManager(&fakePlatformInterface{}, nil, networkConfig{ChangeDelay: badoption.Duration(changeDelay)})
+			recorder := new(networkEventRecorder)
+			manager.setEventListener(recorder)
+			for _, interfaceName := range testCase.updates {
+				var interfaceIndex int32
+				if interfaceName != "" {
+					interfaceIndex = int32(len(interfaceName))
+				}
+				manager.UpdateDefaultInterface(interfaceName, interfaceIndex, false, false)
+			}
+			time.Sleep(changeDelay * 5)
+			names := recorder.interfaceNames()
+			if len(names) != len(testCase.expected) {
+				t.Fatalf("expected events %v, got %v", testCase.expected, names)
+			}
+			for i := range names {
+				if names[i] != testCase.expected[i] {
+					t.Fatalf("expected events %v, got %v", testCase.expected, names)
+				}
+			}
+		})
+	}
+}
+
+func TestNetworkManagerUpdate(t *testing.T) {
+	manager := newNetworkManager(&fakePlatformInterface{interfaces: []*NetworkInterface{
+		nil,
+		{
+			Index:     1,
+			Name:      "en0",
+			Addresses: newIterator([]string{"192.168.1.2/24", "invalid", "fe80::1%en0/64", "2001:db8::1"}),
+		},
+	}}, nil, networkConfig{})
+	err := manager.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	interfaces := manager.Interfaces()
+	if len(interfaces) != 1 || interfaces[0].Name != "en0" {
+		t.Fatalf("unexpected interfaces %v", interfaces)
+	}
+	expected := []string{"192.168.1.2/24", "fe80::1/64", "2001:db8::1/128"}
+	addresses := interfaces[0].Addresses
+	if len(addresses) != len(expected) {
+		t.Fatalf("expected addresses %v, got %v", expected, addresses)
+	}
+	for i := range addresses {
+		if addresses[i].String() != expected[i] {
+			t.Fatalf("expected addresses %v, got %v", expected, addresses)
+		}
+	}
+}
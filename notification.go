@@ -0,0 +1,124 @@
+package libbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nekohasekai/libwtf/internal/conntrack"
+
+	F "github.com/sagernet/sing/common/format"
+	"github.com/v2fly/v2ray-core/v5/common/log"
+)
+
+type Notification struct {
+	Identifier string
+	TypeName   string
+	Title      string
+	Subtitle   string
+	Body       string
+	OpenURL    string
+}
+
+const notificationInterval = 10 * time.Minute
+
+// notifier sends notifications through the platform, at most one per identifier every notificationInterval.
+type notifier struct {
+	iif      PlatformInterface
+	access   sync.Mutex
+	lastSent map[string]time.Time
+}
+
+func newNotifier(iif PlatformInterface) *notifier {
+	return &notifier{
+		iif:      iif,
+		lastSent: make(map[string]time.Time),
+	}
+}
+
+func (n *notifier) send(notification *Notification) {
+	n.access.Lock()
+	nowTime := time.Now()
+	for identifier, lastSent := range n.lastSent {
+		if nowTime.Sub(lastSent) >= notificationInterval {
+			delete(n.lastSent, identifier)
+		}
+	}
+	if lastSent, loaded := n.lastSent[notification.Identifier]; loaded && nowTime.Sub(lastSent) < notificationInterval {
+		n.access.Unlock()
+		return
+	}
+	n.lastSent[notification.Identifier] = nowTime
+	n.access.Unlock()
+	err := n.iif.SendNotification(notification)
+	if err != nil {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Warning,
+			Content:  F.ToString("send notification ", notification.Identifier, ": ", err),
+		})
+	}
+}
+
+func (n *notifier) sendOOMKilled() {
+	n.send(&Notification{
+		Identifier: "oom-killer",
+		TypeName:   "Memory",
+		Title:      "Connections closed",
+		Body:       "All connections were closed because the memory limit was reached.",
+	})
+}
+
+func (n *notifier) sendSubscriptionUpdateFailed(name string, message string) {
+	n.send(&Notification{
+		Identifier: "subscription-update-failed-" + name,
+		TypeName:   "Subscription",
+		Title:      "Subscription update failed",
+		Subtitle:   name,
+		Body:       message,
+	})
+}
+
+func (n *notifier) sendConfigWarnings(warnings []string) {
+	for _, warning := range warnings {
+		n.send(&Notification{
+			Identifier: configWarningIdentifier(warning),
+			TypeName:   "Configuration",
+			Title:      "Configuration warning",
+			Body:       warning,
+		})
+	}
+}
+
+// configWarningIdentifier derives a short identifier that is stable across restarts from the warning text.
+func configWarningIdentifier(warning string) string {
+	hash := sha256.Sum256([]byte(warning))
+	return "config-warning-" + hex.EncodeToString(hash[:8])
+}
+
+// activeNotifier reports OOM killer activations, the killer is global so only the last started service is notified.
+var activeNotifier atomic.Pointer[notifier]
+
+func init() {
+	conntrack.KillerHandler = func() {
+		if n := activeNotifier.Load(); n != nil {
+			go n.sendOOMKilled()
+		}
+	}
+}
+
+func (n *notifier) start(warnings []string) {
+	activeNotifier.Store(n)
+	for _, warning := range warnings {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Warning,
+			Content:  F.ToString("config: ", warning),
+		})
+	}
+	go n.sendConfigWarnings(warnings)
+}
+
+func (n *notifier) close() {
+	activeNotifier.CompareAndSwap(n, nil)
+}
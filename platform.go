@@ -12,12 +12,12 @@ type PlatformInterface interface {
 	UIDByPackageName(packageName string) (int32, error)
 	StartDefaultInterfaceMonitor(listener InterfaceUpdateListener) error
 	CloseDefaultInterfaceMonitor(listener InterfaceUpdateListener) error
-	// GetInterfaces() (NetworkInterfaceIterator, error)
+	GetInterfaces() (NetworkInterfaceIterator, error)
 	UnderNetworkExtension() bool
 	IncludeAllNetworks() bool
-	// ReadWIFIState() *WIFIState
+	ReadWIFIState() *WIFIState
 	ClearDNSCache()
-	// SendNotification(notification *Notification) error
+	SendNotification(notification *Notification) error
 }
 
 type TunInterface interface {
@@ -28,3 +28,27 @@ type TunInterface interface {
 type InterfaceUpdateListener interface {
 	UpdateDefaultInterface(interfaceName string, interfaceIndex int32, isExpensive bool, isConstrained bool)
 }
+
+type NetworkInterface struct {
+	Index int32
+	MTU   int32
+	Name  string
+	// Addresses are interface prefixes such as `192.168.1.2/24`.
+	Addresses StringIterator
+	// Flags are net.Flags bits.
+	Flags int32
+}
+
+type NetworkInterfaceIterator interface {
+	Next() *NetworkInterface
+	HasNext() bool
+}
+
+type WIFIState struct {
+	SSID  string
+	BSSID string
+}
+
+func NewWIFIState(wifiSSID string, wifiBSSID string) *WIFIState {
+	return &WIFIState{wifiSSID, wifiBSSID}
+}
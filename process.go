@@ -0,0 +1,76 @@
+package libbox
+
+import (
+	"syscall"
+
+	F "github.com/sagernet/sing/common/format"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/v2fly/v2ray-core/v5/common/log"
+	"github.com/v2fly/v2ray-core/v5/common/protocol"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+)
+
+type connectionOwner struct {
+	UID         int32
+	PackageName string
+}
+
+func (o *connectionOwner) String() string {
+	if o.PackageName != "" {
+		return o.PackageName
+	}
+	return F.ToString(o.UID)
+}
+
+func (t *tun2ray) findConnectionOwner(ipProtocol int32, source M.Socksaddr, destination M.Socksaddr) (*connectionOwner, error) {
+	var (
+		uid int32
+		err error
+	)
+	if t.iif.UseProcFS() {
+		uid, err = findProcessUIDByProcFS(ipProtocol, source.AddrPort())
+	} else {
+		uid, err = t.iif.FindConnectionOwner(ipProtocol, source.AddrString(), int32(source.Port), destination.AddrString(), int32(destination.Port))
+	}
+	if err != nil {
+		return nil, err
+	}
+	owner := &connectionOwner{UID: uid}
+	owner.PackageName, _ = t.iif.PackageNameByUid(uid)
+	return owner, nil
+}
+
+// attachConnectionOwner sets the owner as the inbound user, so it can be matched by the `user` routing field,
+// and as `uid` and `package` content attributes. It returns nil if the owner is not found.
+func (t *tun2ray) attachConnectionOwner(inbound *session.Inbound, content *session.Content, network string, source M.Socksaddr, destination M.Socksaddr) *connectionOwner {
+	if !t.options.FindProcess {
+		return nil
+	}
+	var ipProtocol int32
+	if network == N.NetworkTCP {
+		ipProtocol = syscall.IPPROTO_TCP
+	} else {
+		ipProtocol = syscall.IPPROTO_UDP
+	}
+	owner, err := t.findConnectionOwner(ipProtocol, source, destination)
+	if err != nil {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Debug,
+			Content:  F.ToString("find connection owner for ", source, ": ", err),
+		})
+		return nil
+	}
+	inbound.User = &protocol.MemoryUser{
+		Email: owner.String(),
+	}
+	content.SetAttribute("uid", F.ToString(owner.UID))
+	if owner.PackageName != "" {
+		content.SetAttribute("package", owner.PackageName)
+	}
+	log.Record(&log.GeneralMessage{
+		Severity: log.Severity_Info,
+		Content:  F.ToString("found connection owner ", owner, " for ", network, " connection from ", source),
+	})
+	return owner
+}
@@ -0,0 +1,104 @@
+package libbox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+func findProcessUIDByProcFS(ipProtocol int32, source netip.AddrPort) (int32, error) {
+	var network string
+	switch ipProtocol {
+	case syscall.IPPROTO_TCP:
+		network = "tcp"
+	case syscall.IPPROTO_UDP:
+		network = "udp"
+	default:
+		return -1, E.New("unknown protocol: ", ipProtocol)
+	}
+	source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+	// IPv4 sockets may be opened as dual-stack IPv6 sockets
+	paths := []string{"/proc/net/" + network + "6"}
+	if source.Addr().Is4() {
+		paths = append([]string{"/proc/net/" + network}, paths...)
+	}
+	for _, path := range paths {
+		uid, err := searchProcNetFile(path, source)
+		if err == nil {
+			return uid, nil
+		}
+		if !os.IsNotExist(err) {
+			return -1, err
+		}
+	}
+	return -1, os.ErrNotExist
+}
+
+func searchProcNetFile(path string, source netip.AddrPort) (int32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return -1, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	// skip header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		localAddr, err := parseProcNetAddrPort(fields[1])
+		if err != nil {
+			continue
+		}
+		if localAddr.Port() != source.Port() {
+			continue
+		}
+		if localAddr.Addr() != source.Addr() && !localAddr.Addr().IsUnspecified() {
+			continue
+		}
+		uid, err := strconv.ParseInt(fields[7], 10, 32)
+		if err != nil {
+			return -1, E.Cause(err, "parse uid")
+		}
+		return int32(uid), nil
+	}
+	err = scanner.Err()
+	if err != nil {
+		return -1, err
+	}
+	return -1, os.ErrNotExist
+}
+
+// parseProcNetAddrPort parses addresses like `0100007F:1F90`,
+// where the address is printed as 32-bit words in host byte order.
+func parseProcNetAddrPort(s string) (netip.AddrPort, error) {
+	addrHex, portHex, found := strings.Cut(s, ":")
+	if !found {
+		return netip.AddrPort{}, E.New("invalid address: ", s)
+	}
+	addrBytes, err := hex.DecodeString(addrHex)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if len(addrBytes) != 4 && len(addrBytes) != 16 {
+		return netip.AddrPort{}, E.New("invalid address: ", s)
+	}
+	for i := 0; i < len(addrBytes); i += 4 {
+		binary.NativeEndian.PutUint32(addrBytes[i:], binary.BigEndian.Uint32(addrBytes[i:]))
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, _ := netip.AddrFromSlice(addrBytes)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
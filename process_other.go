@@ -0,0 +1,12 @@
+//go:build !linux
+
+package libbox
+
+import (
+	"net/netip"
+	"os"
+)
+
+func findProcessUIDByProcFS(ipProtocol int32, source netip.AddrPort) (int32, error) {
+	return -1, os.ErrInvalid
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/binary"
+	"io"
 
 	E "github.com/sagernet/sing/common/exceptions"
 	"github.com/sagernet/sing/common/varbin"
@@ -170,12 +171,13 @@ type ProfileContent struct {
 	AutoUpdate         bool
 	AutoUpdateInterval int32
 	LastUpdated        int64
+	SubscriptionInfo   *SubscriptionInfo
 }
 
 func (c *ProfileContent) Encode() []byte {
 	buffer := new(bytes.Buffer)
 	buffer.WriteByte(MessageTypeProfileContent)
-	buffer.WriteByte(1)
+	buffer.WriteByte(2)
 	gWriter := gzip.NewWriter(buffer)
 	writer := bufio.NewWriter(gWriter)
 	varbin.Write(writer, binary.BigEndian, c.Name)
@@ -188,6 +190,14 @@ func (c *ProfileContent) Encode() []byte {
 		binary.Write(writer, binary.BigEndian, c.AutoUpdate)
 		binary.Write(writer, binary.BigEndian, c.AutoUpdateInterval)
 		binary.Write(writer, binary.BigEndian, c.LastUpdated)
+		binary.Write(writer, binary.BigEndian, c.SubscriptionInfo != nil)
+		if c.SubscriptionInfo != nil {
+			binary.Write(writer, binary.BigEndian, c.SubscriptionInfo.Upload)
+			binary.Write(writer, binary.BigEndian, c.SubscriptionInfo.Download)
+			binary.Write(writer, binary.BigEndian, c.SubscriptionInfo.Total)
+			binary.Write(writer, binary.BigEndian, c.SubscriptionInfo.Expire)
+			binary.Write(writer, binary.BigEndian, c.SubscriptionInfo.UpdateInterval)
+		}
 	}
 	writer.Flush()
 	gWriter.Flush()
@@ -247,6 +257,42 @@ func DecodeProfileContent(data []byte) (*ProfileContent, error) {
 		if err != nil {
 			return nil, err
 		}
+		if version >= 2 {
+			content.SubscriptionInfo, err = readSubscriptionInfo(bReader)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 	return &content, nil
 }
+
+func readSubscriptionInfo(reader io.Reader) (*SubscriptionInfo, error) {
+	var hasInfo bool
+	err := binary.Read(reader, binary.BigEndian, &hasInfo)
+	if err != nil || !hasInfo {
+		return nil, err
+	}
+	var info SubscriptionInfo
+	err = binary.Read(reader, binary.BigEndian, &info.Upload)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &info.Download)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &info.Total)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &info.Expire)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &info.UpdateInterval)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
@@ -0,0 +1,261 @@
+package libbox
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"slices"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/app/router"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	v2rayCommon "github.com/v2fly/v2ray-core/v5/common"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/serial"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+	routingSession "github.com/v2fly/v2ray-core/v5/features/routing/session"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/cfgcommon"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/geodata"
+	v4Rule "github.com/v2fly/v2ray-core/v5/infra/conf/rule"
+	"google.golang.org/protobuf/proto"
+)
+
+type RouteExplanation struct {
+	// MatchedRule is the index of the matched routing rule, -1 if the default outbound is used.
+	MatchedRule int32
+	BalancerTag string
+	OutboundTag string
+	// NetworkPolicy reports that a network policy decided instead of the routing rules.
+	NetworkPolicy bool
+	Blocked       bool
+}
+
+// explainRoute routes a synthetic TUN flow like tun2ray does, without sniffing.
+func (s *Service) explainRoute(destination string, port int32, network string, inboundTag string) (*RouteExplanation, error) {
+	if port < 1 || port > 65535 {
+		return nil, E.New("invalid port: ", port)
+	}
+	var vDestination v2rayNet.Destination
+	switch network {
+	case "", N.NetworkTCP:
+		network = N.NetworkTCP
+		vDestination = v2rayNet.TCPDestination(v2rayNet.ParseAddress(destination), v2rayNet.Port(port))
+	case N.NetworkUDP:
+		vDestination = v2rayNet.UDPDestination(v2rayNet.ParseAddress(destination), v2rayNet.Port(port))
+	default:
+		return nil, E.New("unknown network: ", network)
+	}
+	socksDestination := M.ParseSocksaddrHostPort(destination, uint16(port))
+	isDNS := s.tun.isDNS(socksDestination)
+	explanation := &RouteExplanation{MatchedRule: -1}
+	if policy := s.tun.network.policy(); policy != nil && !isDNS {
+		if policy.BlockAllUDP && network == N.NetworkUDP {
+			explanation.NetworkPolicy = true
+			explanation.Blocked = true
+			return explanation, nil
+		}
+		if policy.OutboundTag != "" {
+			explanation.NetworkPolicy = true
+			explanation.OutboundTag = policy.OutboundTag
+			return explanation, nil
+		}
+	}
+	if inboundTag == "" {
+		inboundTag = s.tun.inboundTag(network, socksDestination, isDNS)
+	}
+	content := new(session.Content)
+	if isDNS {
+		content.Protocol = "dns"
+	}
+	s.tun.attachNetworkState(content)
+	ctx := toContext(s.ctx, s.instance)
+	ctx = session.ContextWithInbound(ctx, &session.Inbound{Tag: inboundTag})
+	ctx = session.ContextWithContent(ctx, content)
+	ctx = session.ContextWithOutbound(ctx, &session.Outbound{Target: vDestination})
+	route, err := s.tun.router.PickRoute(routingSession.AsRoutingContext(ctx))
+	if err != nil {
+		if err != v2rayCommon.ErrNoClue {
+			return nil, err
+		}
+		outboundManager := s.instance.GetFeature(outbound.ManagerType()).(outbound.Manager)
+		if handler := outboundManager.GetDefaultHandler(); handler != nil {
+			explanation.OutboundTag = handler.Tag()
+		}
+		return explanation, nil
+	}
+	explanation.OutboundTag = route.GetOutboundTag()
+	// the router does not tell which rule matched, so apply the rules again on the context it matched with.
+	// They are built one at a time and dropped, since they hold the loaded geodata.
+	for i, source := range s.routingRules {
+		rule, err := source.build()
+		if err != nil {
+			return nil, E.Cause(err, "build routing rule ", i)
+		}
+		condition, err := rule.BuildCondition()
+		if err != nil {
+			return nil, E.Cause(err, "build routing rule ", i)
+		}
+		if condition.Apply(route) {
+			explanation.MatchedRule = int32(i)
+			explanation.BalancerTag = rule.GetBalancingTag()
+			break
+		}
+	}
+	return explanation, nil
+}
+
+// routingRuleSource is a routing rule as configured, which is built with its geodata on demand,
+// so that the service does not keep a copy of the geodata loaded by the router.
+type routingRuleSource interface {
+	build() (*router.RoutingRule, error)
+}
+
+// routingRuleSources extracts the routing rules of a built v5 config, where geodata is loaded by the router.
+func routingRuleSources(config *core.Config) ([]routingRuleSource, error) {
+	var sources []routingRuleSource
+	for _, app := range config.App {
+		message, err := serial.GetInstanceOf(app)
+		if err != nil {
+			return nil, err
+		}
+		switch config := message.(type) {
+		case *router.Config:
+			sources = common.Map(config.Rule, func(it *router.RoutingRule) routingRuleSource {
+				return builtRoutingRule{it}
+			})
+		case *router.SimplifiedConfig:
+			sources = common.Map(config.Rule, func(it *router.SimplifiedRoutingRule) routingRuleSource {
+				return simplifiedRoutingRule{it}
+			})
+		}
+	}
+	return sources, nil
+}
+
+// builtRoutingRule is a rule of a protobuf router config, which has its geodata inline.
+type builtRoutingRule struct {
+	rule *router.RoutingRule
+}
+
+func (r builtRoutingRule) build() (*router.RoutingRule, error) {
+	return r.rule, nil
+}
+
+type simplifiedRoutingRule struct {
+	rule *router.SimplifiedRoutingRule
+}
+
+func (r simplifiedRoutingRule) build() (*router.RoutingRule, error) {
+	return buildSimplifiedRoutingRule(r.rule)
+}
+
+// v4RoutingRule is a rule of a v4 config, whose router config is built with the geodata loaded.
+type v4RoutingRule struct {
+	rule          stdjson.RawMessage
+	domainMatcher string
+}
+
+func (r v4RoutingRule) build() (*router.RoutingRule, error) {
+	ctx := cfgcommon.NewConfigureLoadingContext(context.Background())
+	cfgcommon.SetGeoDataLoader(ctx, common.Must1(geodata.GetGeoDataLoader("memconservative")))
+	rule, err := v4Rule.ParseRule(ctx, r.rule)
+	if err != nil {
+		return nil, err
+	}
+	if rule.DomainMatcher == "" {
+		rule.DomainMatcher = r.domainMatcher
+	}
+	return rule, nil
+}
+
+// buildSimplifiedRoutingRule converts a v5 routing rule like the V2Ray router does,
+// but loads geodata with the memconservative loader into copies of the geo messages,
+// which are shared with the rule sources of the service.
+func buildSimplifiedRoutingRule(simplifiedRule *router.SimplifiedRoutingRule) (*router.RoutingRule, error) {
+	loader := common.Must1(geodata.GetGeoDataLoader("memconservative"))
+	loadGeoIP := func(geoipList []*routercommon.GeoIP) ([]*routercommon.GeoIP, error) {
+		loadedList := make([]*routercommon.GeoIP, 0, len(geoipList))
+		for _, geoip := range geoipList {
+			if geoip.Code == "" {
+				loadedList = append(loadedList, geoip)
+				continue
+			}
+			geoip = proto.Clone(geoip).(*routercommon.GeoIP)
+			fileName := geoip.FilePath
+			if fileName == "" {
+				fileName = "geoip.dat"
+				geoip.CountryCode = geoip.Code
+			}
+			var err error
+			geoip.Cidr, err = loader.LoadIP(fileName, geoip.Code)
+			if err != nil {
+				return nil, E.Cause(err, "load geoip ", geoip.Code)
+			}
+			loadedList = append(loadedList, geoip)
+		}
+		return loadedList, nil
+	}
+	rule := &router.RoutingRule{
+		Geoip:         simplifiedRule.Geoip,
+		SourceGeoip:   simplifiedRule.SourceGeoip,
+		Domain:        simplifiedRule.Domain,
+		GeoDomain:     slices.Clone(simplifiedRule.GeoDomain),
+		Networks:      simplifiedRule.Networks.GetNetwork(),
+		Protocol:      simplifiedRule.Protocol,
+		Attributes:    simplifiedRule.Attributes,
+		UserEmail:     simplifiedRule.UserEmail,
+		InboundTag:    simplifiedRule.InboundTag,
+		DomainMatcher: simplifiedRule.DomainMatcher,
+	}
+	var err error
+	rule.Geoip, err = loadGeoIP(rule.Geoip)
+	if err != nil {
+		return nil, err
+	}
+	rule.SourceGeoip, err = loadGeoIP(rule.SourceGeoip)
+	if err != nil {
+		return nil, err
+	}
+	for i, geosite := range rule.GeoDomain {
+		if geosite.Code == "" {
+			continue
+		}
+		geosite = proto.Clone(geosite).(*routercommon.GeoSite)
+		fileName := geosite.FilePath
+		if fileName == "" {
+			fileName = "geosite.dat"
+		}
+		geosite.Domain, err = loader.LoadGeoSiteWithAttr(fileName, geosite.Code)
+		if err != nil {
+			return nil, E.Cause(err, "load geosite ", geosite.Code)
+		}
+		rule.GeoDomain[i] = geosite
+	}
+	if simplifiedRule.PortList != "" {
+		var portList cfgcommon.PortList
+		err = portList.UnmarshalText(simplifiedRule.PortList)
+		if err != nil {
+			return nil, err
+		}
+		rule.PortList = portList.Build()
+	}
+	if simplifiedRule.SourcePortList != "" {
+		var portList cfgcommon.PortList
+		err = portList.UnmarshalText(simplifiedRule.SourcePortList)
+		if err != nil {
+			return nil, err
+		}
+		rule.SourcePortList = portList.Build()
+	}
+	switch target := simplifiedRule.TargetTag.(type) {
+	case *router.SimplifiedRoutingRule_Tag:
+		rule.TargetTag = &router.RoutingRule_Tag{Tag: target.Tag}
+	case *router.SimplifiedRoutingRule_BalancingTag:
+		rule.TargetTag = &router.RoutingRule_BalancingTag{BalancingTag: target.BalancingTag}
+	}
+	return rule, nil
+}
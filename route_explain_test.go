@@ -0,0 +1,86 @@
+package libbox
+
+import (
+	"context"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+)
+
+func TestExplainRoute(t *testing.T) {
+	for _, testCase := range []struct {
+		format string
+		config string
+	}{
+		{ConfigFormatV4, `{
+	"outbounds": [
+		{"protocol": "freedom", "tag": "direct"},
+		{"protocol": "blackhole", "tag": "proxy"},
+		{"protocol": "freedom", "tag": "ip"}
+	],
+	"routing": {"rules": [
+		{"type": "field", "domain": ["domain:example.com"], "outboundTag": "proxy"},
+		{"type": "field", "ip": ["1.2.3.4/32"], "port": "443", "outboundTag": "ip"}
+	]}
+}`},
+		{ConfigFormatV5, `{
+	"outbounds": [
+		{"protocol": "freedom", "tag": "direct"},
+		{"protocol": "blackhole", "tag": "proxy"},
+		{"protocol": "freedom", "tag": "ip"}
+	],
+	"router": {"rule": [
+		{"domain": [{"type": "RootDomain", "value": "example.com"}], "tag": "proxy"},
+		{"geoip": [{"cidr": [{"ipAddr": "1.2.3.4", "prefix": 32}]}], "portList": "443", "tag": "ip"}
+	]}
+}`},
+	} {
+		t.Run(testCase.format, func(t *testing.T) {
+			options, config, err := parseConfig(testCase.config, testCase.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(options.routingRules) != 2 {
+				t.Fatalf("expected 2 routing rules, got %d", len(options.routingRules))
+			}
+			instance, err := core.New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			service := &Service{
+				ctx:      context.Background(),
+				instance: instance,
+				tun: &tun2ray{
+					router:  instance.GetFeature(routing.RouterType()).(routing.Router),
+					network: newNetworkManager(&fakePlatformInterface{}, nil, networkConfig{}),
+				},
+				routingRules: options.routingRules,
+			}
+			for _, explainCase := range []struct {
+				destination string
+				port        int32
+				matchedRule int32
+				outboundTag string
+			}{
+				{"www.example.com", 80, 0, "proxy"},
+				{"1.2.3.4", 443, 1, "ip"},
+				{"1.2.3.4", 80, -1, "direct"},
+			} {
+				explanation, err := service.explainRoute(explainCase.destination, explainCase.port, "", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if explanation.MatchedRule != explainCase.matchedRule || explanation.OutboundTag != explainCase.outboundTag {
+					t.Fatalf("%s:%d: expected rule %d to %s, got %+v", explainCase.destination, explainCase.port, explainCase.matchedRule, explainCase.outboundTag, explanation)
+				}
+			}
+			for _, port := range []int32{0, -1, 65536} {
+				_, err = service.explainRoute("1.2.3.4", port, "", "")
+				if err == nil {
+					t.Fatalf("port %d: expected error", port)
+				}
+			}
+		})
+	}
+}
@@ -13,14 +13,21 @@ import (
 )
 
 type Service struct {
-	ctx      context.Context
-	cancel   context.CancelFunc
-	instance *core.Instance
-	tun      *tun2ray
+	ctx          context.Context
+	cancel       context.CancelFunc
+	instance     *core.Instance
+	tun          *tun2ray
+	notifier     *notifier
+	warnings     []string
+	routingRules []routingRuleSource
 }
 
 func NewService(configContent string, platformInterface PlatformInterface) (*Service, error) {
-	config, err := parseConfig(configContent)
+	return NewServiceWithFormat(configContent, ConfigFormatAuto, platformInterface)
+}
+
+func NewServiceWithFormat(configContent string, format string, platformInterface PlatformInterface) (*Service, error) {
+	options, config, err := parseConfig(configContent, format)
 	if err != nil {
 		return nil, err
 	}
@@ -31,10 +38,13 @@ func NewService(configContent string, platformInterface PlatformInterface) (*Ser
 		return nil, E.Cause(err, "create service")
 	}
 	return &Service{
-		ctx:      ctx,
-		cancel:   cancel,
-		instance: instance,
-		tun:      newTun2ray(ctx, instance, platformInterface),
+		ctx:          ctx,
+		cancel:       cancel,
+		instance:     instance,
+		tun:          newTun2ray(ctx, instance, platformInterface, options.TUN, options.Network),
+		notifier:     newNotifier(platformInterface),
+		warnings:     options.warnings(),
+		routingRules: options.routingRules,
 	}, nil
 }
 
@@ -57,12 +67,25 @@ func (s *Service) Start() error {
 		}
 	}
 	runtimeDebug.FreeOSMemory()
-	return s.tun.Start()
+	err := s.tun.Start()
+	if err != nil {
+		return err
+	}
+	s.notifier.start(s.warnings)
+	return nil
+}
+
+// NotifySubscriptionUpdateFailed notifies the user that the app failed to update a subscription,
+// at most once per subscription every 10 minutes. Apps running the service in an extension
+// call CommandClient.NotifySubscriptionUpdateFailed instead.
+func (s *Service) NotifySubscriptionUpdateFailed(name string, message string) {
+	go s.notifier.sendSubscriptionUpdateFailed(name, message)
 }
 
 func (s *Service) Close() error {
 	const FatalStopTimeout = 10 * time.Second
 	s.cancel()
+	s.notifier.close()
 	var err error
 	done := make(chan struct{})
 	go func() {
@@ -14,6 +14,7 @@ import (
 	"github.com/nekohasekai/libwtf/internal/humanize"
 
 	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
 	F "github.com/sagernet/sing/common/format"
 	"github.com/sagernet/sing/common/rw"
 	"github.com/v2fly/v2ray-core/v5"
@@ -28,6 +29,7 @@ var (
 	sGroupID         int
 	sTVOS            bool
 	sFixAndroidStack bool
+	sAssetReader     AssetReader
 )
 
 func init() {
@@ -79,21 +81,14 @@ type AssetReader interface {
 }
 
 func SetupV2Ray(reader AssetReader) {
+	sAssetReader = reader
 	filesystem.NewFileSeeker = func(path string) (io.ReadSeekCloser, error) {
 		_, fileName := filepath.Split(path)
 		workFile := filepath.Join(sWorkingPath, fileName)
 		if rw.IsFile(workFile) {
 			return os.Open(workFile)
 		}
-		var (
-			content []byte
-			err     error
-		)
-		if strings.HasSuffix(fileName, ".dat") {
-			content, err = reader.ReadAsset(common.SubstringBefore(fileName, ".dat"))
-		} else {
-			content, err = reader.ReadAsset(fileName)
-		}
+		content, err := readBundledAsset(fileName)
 		if err != nil {
 			return nil, err
 		}
@@ -110,6 +105,16 @@ func SetupV2Ray(reader AssetReader) {
 	}
 }
 
+func readBundledAsset(fileName string) ([]byte, error) {
+	if sAssetReader == nil {
+		return nil, E.New("missing asset reader")
+	}
+	if strings.HasSuffix(fileName, ".dat") {
+		return sAssetReader.ReadAsset(common.SubstringBefore(fileName, ".dat"))
+	}
+	return sAssetReader.ReadAsset(fileName)
+}
+
 func SetLocale(localeId string) {
 	// not used by v2ray
 }
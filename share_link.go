@@ -0,0 +1,608 @@
+package libbox
+
+import (
+	"encoding/base64"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/json"
+)
+
+// ShareLink describes a proxy server shared by a `vmess://`, `vless://`, `trojan://`, `ss://` or `socks://` link.
+type ShareLink struct {
+	// Protocol is the V2Ray outbound protocol: vmess, vless, trojan, shadowsocks or socks.
+	Protocol string
+	Name     string
+	Address  string
+	Port     int32
+	UUID     string
+	Username string
+	Password string
+	// Method is the shadowsocks method, or the vmess security.
+	Method string
+	// Transport is one of tcp, ws, grpc, h2 and httpupgrade.
+	Transport string
+	Host      string
+	// Path is the HTTP path, or the gRPC service name.
+	Path       string
+	TLS        bool
+	ServerName string
+	// ALPN is a comma separated list.
+	ALPN string
+}
+
+func ParseShareLink(link string) (*ShareLink, error) {
+	return parseShareLink(strings.TrimSpace(link))
+}
+
+func parseShareLink(link string) (*ShareLink, error) {
+	scheme, _, _ := strings.Cut(link, "://")
+	switch strings.ToLower(scheme) {
+	case "vmess":
+		return parseVMessLink(link)
+	case "vless":
+		return parseURLShareLink(link, "vless")
+	case "trojan":
+		return parseURLShareLink(link, "trojan")
+	case "ss":
+		return parseShadowsocksLink(link)
+	case "socks", "socks5":
+		return parseSocksLink(link)
+	default:
+		return nil, E.New("unsupported share link: ", scheme)
+	}
+}
+
+func decodeBase64String(content string) ([]byte, error) {
+	content = strings.TrimSpace(content)
+	content = strings.NewReplacer("-", "+", "_", "/").Replace(content)
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(content, "="))
+}
+
+// vmessLink is the v2rayN format, where numbers are sent as either strings or numbers.
+type vmessLink struct {
+	Name       any `json:"ps"`
+	Address    any `json:"add"`
+	Port       any `json:"port"`
+	UUID       any `json:"id"`
+	Security   any `json:"scy"`
+	Network    any `json:"net"`
+	Host       any `json:"host"`
+	Path       any `json:"path"`
+	TLS        any `json:"tls"`
+	ServerName any `json:"sni"`
+	ALPN       any `json:"alpn"`
+}
+
+func linkString(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+func parseVMessLink(link string) (*ShareLink, error) {
+	content, err := decodeBase64String(link[len("vmess://"):])
+	if err != nil {
+		return nil, E.Cause(err, "decode vmess link")
+	}
+	var options vmessLink
+	err = json.Unmarshal(content, &options)
+	if err != nil {
+		return nil, E.Cause(err, "parse vmess link")
+	}
+	port, err := strconv.ParseUint(linkString(options.Port), 10, 16)
+	if err != nil {
+		return nil, E.Cause(err, "parse vmess port")
+	}
+	shareLink := &ShareLink{
+		Protocol:   "vmess",
+		Name:       linkString(options.Name),
+		Address:    linkString(options.Address),
+		Port:       int32(port),
+		UUID:       linkString(options.UUID),
+		Method:     linkString(options.Security),
+		Transport:  linkString(options.Network),
+		Host:       linkString(options.Host),
+		Path:       linkString(options.Path),
+		TLS:        linkString(options.TLS) == "tls",
+		ServerName: linkString(options.ServerName),
+		ALPN:       linkString(options.ALPN),
+	}
+	return shareLink, shareLink.check()
+}
+
+func parseURLShareLink(link string, protocol string) (*ShareLink, error) {
+	linkURL, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(linkURL.Port(), 10, 16)
+	if err != nil {
+		return nil, E.Cause(err, "parse ", protocol, " port")
+	}
+	query := linkURL.Query()
+	shareLink := &ShareLink{
+		Protocol:   protocol,
+		Name:       linkURL.Fragment,
+		Address:    linkURL.Hostname(),
+		Port:       int32(port),
+		Transport:  query.Get("type"),
+		Host:       query.Get("host"),
+		Path:       query.Get("path"),
+		ServerName: query.Get("sni"),
+		ALPN:       query.Get("alpn"),
+	}
+	if shareLink.Transport == "grpc" {
+		shareLink.Path = query.Get("serviceName")
+	}
+	switch protocol {
+	case "vless":
+		shareLink.UUID = linkURL.User.Username()
+		shareLink.TLS = query.Get("security") == "tls"
+		if flow := query.Get("flow"); flow != "" {
+			return nil, E.New("unsupported vless flow: ", flow)
+		}
+		if security := query.Get("security"); security != "" && security != "none" && security != "tls" {
+			return nil, E.New("unsupported vless security: ", security)
+		}
+	case "trojan":
+		shareLink.Password = linkURL.User.Username()
+		shareLink.TLS = query.Get("security") != "none"
+		if shareLink.ServerName == "" {
+			shareLink.ServerName = query.Get("peer")
+		}
+	}
+	return shareLink, shareLink.check()
+}
+
+// parseShadowsocksLink parses SIP002 links, and legacy links with the whole server base64 encoded.
+func parseShadowsocksLink(link string) (*ShareLink, error) {
+	content, name, _ := strings.Cut(link[len("ss://"):], "#")
+	name, _ = url.PathUnescape(name)
+	content, _, _ = strings.Cut(content, "?")
+	content = strings.TrimSuffix(content, "/")
+	if !strings.Contains(content, "@") {
+		decoded, err := decodeBase64String(content)
+		if err != nil {
+			return nil, E.Cause(err, "decode shadowsocks link")
+		}
+		content = string(decoded)
+	}
+	userInfo, server, found := strings.Cut(content, "@")
+	if !found {
+		return nil, E.New("invalid shadowsocks link")
+	}
+	if decoded, err := decodeBase64String(userInfo); err == nil && strings.Contains(string(decoded), ":") {
+		userInfo = string(decoded)
+	} else {
+		userInfo, _ = url.PathUnescape(userInfo)
+	}
+	method, password, found := strings.Cut(userInfo, ":")
+	if !found {
+		return nil, E.New("invalid shadowsocks user info")
+	}
+	host, portString, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, E.Cause(err, "parse shadowsocks server")
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, E.Cause(err, "parse shadowsocks port")
+	}
+	shareLink := &ShareLink{
+		Protocol: "shadowsocks",
+		Name:     name,
+		Address:  host,
+		Port:     int32(port),
+		Method:   method,
+		Password: password,
+	}
+	return shareLink, shareLink.check()
+}
+
+// parseSocksLink parses links with the user info either plain or base64 encoded.
+func parseSocksLink(link string) (*ShareLink, error) {
+	linkURL, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(linkURL.Port(), 10, 16)
+	if err != nil {
+		return nil, E.Cause(err, "parse socks port")
+	}
+	shareLink := &ShareLink{
+		Protocol: "socks",
+		Name:     linkURL.Fragment,
+		Address:  linkURL.Hostname(),
+		Port:     int32(port),
+	}
+	if linkURL.User != nil {
+		shareLink.Username = linkURL.User.Username()
+		shareLink.Password, _ = linkURL.User.Password()
+		if decoded, err := decodeBase64String(shareLink.Username); err == nil && shareLink.Password == "" && strings.Contains(string(decoded), ":") {
+			shareLink.Username, shareLink.Password, _ = strings.Cut(string(decoded), ":")
+		}
+	}
+	return shareLink, shareLink.check()
+}
+
+func (l *ShareLink) check() error {
+	if l.Address == "" || l.Port == 0 {
+		return E.New("missing server address")
+	}
+	switch l.Transport {
+	case "", "tcp", "ws", "grpc", "h2", "httpupgrade":
+	case "http":
+		l.Transport = "h2"
+	default:
+		return E.New("unsupported transport: ", l.Transport)
+	}
+	return nil
+}
+
+type shareLinkOutbound struct {
+	Protocol       string           `json:"protocol"`
+	Tag            string           `json:"tag,omitempty"`
+	Settings       any              `json:"settings"`
+	StreamSettings *shareLinkStream `json:"streamSettings,omitempty"`
+}
+
+type shareLinkStream struct {
+	Transport         string `json:"transport,omitempty"`
+	TransportSettings any    `json:"transportSettings,omitempty"`
+	Security          string `json:"security,omitempty"`
+	SecuritySettings  any    `json:"securitySettings,omitempty"`
+}
+
+var vmessSecurityTypes = map[string]string{
+	"aes-128-gcm":       "AES128_GCM",
+	"chacha20-poly1305": "CHACHA20_POLY1305",
+	"none":              "NONE",
+	"zero":              "ZERO",
+}
+
+// outbound builds the V2Ray v5 outbound config, with simplified protocol settings if possible.
+func (l *ShareLink) outbound(tag string) (*shareLinkOutbound, error) {
+	outbound := &shareLinkOutbound{
+		Protocol: l.Protocol,
+		Tag:      tag,
+	}
+	switch l.Protocol {
+	case "vmess":
+		securityType, isFull := vmessSecurityTypes[l.Method]
+		if !isFull {
+			outbound.Settings = map[string]any{"address": l.Address, "port": l.Port, "uuid": l.UUID}
+			break
+		}
+		outbound.Protocol = "#v2ray.core.proxy.vmess.outbound.Config"
+		outbound.Settings = map[string]any{
+			"Receiver": []any{map[string]any{
+				"address": l.Address,
+				"port":    l.Port,
+				"user": []any{map[string]any{"account": map[string]any{
+					"@type":            "v2ray.core.proxy.vmess.Account",
+					"id":               l.UUID,
+					"securitySettings": map[string]any{"type": securityType},
+				}}},
+			}},
+		}
+	case "vless":
+		outbound.Settings = map[string]any{"address": l.Address, "port": l.Port, "uuid": l.UUID}
+	case "trojan":
+		outbound.Settings = map[string]any{"address": l.Address, "port": l.Port, "password": l.Password}
+	case "shadowsocks":
+		if strings.HasPrefix(l.Method, "2022-") {
+			outbound.Protocol = "shadowsocks2022"
+			outbound.Settings = map[string]any{"address": l.Address, "port": l.Port, "method": l.Method, "psk": l.Password}
+		} else {
+			outbound.Settings = map[string]any{"address": l.Address, "port": l.Port, "method": l.Method, "password": l.Password}
+		}
+	case "socks":
+		if l.Username == "" && l.Password == "" {
+			outbound.Settings = map[string]any{"address": l.Address, "port": l.Port}
+			break
+		}
+		outbound.Protocol = "#v2ray.core.proxy.socks.ClientConfig"
+		outbound.Settings = map[string]any{
+			"server": []any{map[string]any{
+				"address": l.Address,
+				"port":    l.Port,
+				"user": []any{map[string]any{"account": map[string]any{
+					"@type":    "v2ray.core.proxy.socks.Account",
+					"username": l.Username,
+					"password": l.Password,
+				}}},
+			}},
+		}
+	default:
+		return nil, E.New("unsupported protocol: ", l.Protocol)
+	}
+	outbound.StreamSettings = l.streamSettings()
+	return outbound, nil
+}
+
+func (l *ShareLink) streamSettings() *shareLinkStream {
+	if (l.Transport == "" || l.Transport == "tcp") && !l.TLS {
+		return nil
+	}
+	stream := &shareLinkStream{Transport: l.Transport}
+	switch l.Transport {
+	case "ws":
+		transportSettings := map[string]any{"path": l.Path}
+		if l.Host != "" {
+			transportSettings["header"] = []any{map[string]any{"key": "Host", "value": l.Host}}
+		}
+		stream.TransportSettings = transportSettings
+	case "grpc":
+		stream.TransportSettings = map[string]any{"serviceName": l.Path}
+	case "h2":
+		transportSettings := map[string]any{"path": l.Path}
+		if l.Host != "" {
+			transportSettings["host"] = strings.Split(l.Host, ",")
+		}
+		stream.TransportSettings = transportSettings
+	case "httpupgrade":
+		stream.TransportSettings = map[string]any{"path": l.Path, "host": l.Host}
+	}
+	if l.TLS {
+		stream.Security = "tls"
+		securitySettings := map[string]any{}
+		if l.ServerName != "" {
+			securitySettings["serverName"] = l.ServerName
+		}
+		if l.ALPN != "" {
+			securitySettings["nextProtocol"] = strings.Split(l.ALPN, ",")
+		}
+		stream.SecuritySettings = securitySettings
+	}
+	return stream
+}
+
+// Outbound returns the V2Ray v5 outbound config of the server.
+func (l *ShareLink) Outbound(tag string) (*StringBox, error) {
+	outbound, err := l.outbound(tag)
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(outbound)
+	if err != nil {
+		return nil, err
+	}
+	return wrapString(string(content)), nil
+}
+
+func (l *ShareLink) Link() (string, error) {
+	server := net.JoinHostPort(l.Address, strconv.Itoa(int(l.Port)))
+	switch l.Protocol {
+	case "vmess":
+		vmessLink := map[string]any{
+			"v":    "2",
+			"ps":   l.Name,
+			"add":  l.Address,
+			"port": strconv.Itoa(int(l.Port)),
+			"id":   l.UUID,
+			"aid":  "0",
+			"scy":  valueOrDefault(l.Method, "auto"),
+			"net":  l.Transport,
+			"type": "none",
+			"host": l.Host,
+			"path": l.Path,
+			"tls":  "",
+			"sni":  l.ServerName,
+			"alpn": l.ALPN,
+		}
+		if l.TLS {
+			vmessLink["tls"] = "tls"
+		}
+		content, err := json.Marshal(vmessLink)
+		if err != nil {
+			return "", err
+		}
+		return "vmess://" + base64.StdEncoding.EncodeToString(content), nil
+	case "vless", "trojan":
+		query := l.linkQuery()
+		linkURL := &url.URL{
+			Scheme:   l.Protocol,
+			Host:     server,
+			Fragment: l.Name,
+		}
+		if l.Protocol == "vless" {
+			query.Set("encryption", "none")
+			linkURL.User = url.User(l.UUID)
+		} else {
+			linkURL.User = url.User(l.Password)
+		}
+		linkURL.RawQuery = query.Encode()
+		return linkURL.String(), nil
+	case "shadowsocks":
+		var userInfo string
+		if strings.HasPrefix(l.Method, "2022-") {
+			// SIP022 keys are already base64, so the user info is percent encoded instead
+			userInfo = url.PathEscape(l.Method) + ":" + url.PathEscape(l.Password)
+		} else {
+			userInfo = base64.RawURLEncoding.EncodeToString([]byte(l.Method + ":" + l.Password))
+		}
+		return "ss://" + userInfo + "@" + server + "#" + url.PathEscape(l.Name), nil
+	case "socks":
+		linkURL := &url.URL{
+			Scheme:   "socks",
+			Host:     server,
+			Fragment: l.Name,
+		}
+		if l.Username != "" || l.Password != "" {
+			linkURL.User = url.User(base64.RawURLEncoding.EncodeToString([]byte(l.Username + ":" + l.Password)))
+		}
+		return linkURL.String(), nil
+	default:
+		return "", E.New("unsupported protocol: ", l.Protocol)
+	}
+}
+
+func valueOrDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func (l *ShareLink) linkQuery() url.Values {
+	query := make(url.Values)
+	if l.TLS {
+		query.Set("security", "tls")
+	} else {
+		query.Set("security", "none")
+	}
+	if l.ServerName != "" {
+		query.Set("sni", l.ServerName)
+	}
+	if l.ALPN != "" {
+		query.Set("alpn", l.ALPN)
+	}
+	// an empty transport is omitted instead of written as tcp, so that links round-trip unchanged
+	if l.Transport != "" {
+		query.Set("type", l.Transport)
+	}
+	if l.Host != "" {
+		query.Set("host", l.Host)
+	}
+	if l.Path != "" {
+		if l.Transport == "grpc" {
+			query.Set("serviceName", l.Path)
+		} else {
+			query.Set("path", l.Path)
+		}
+	}
+	return query
+}
+
+// GenerateShareLink generates the share link of a V2Ray v5 outbound config, named by its tag.
+func GenerateShareLink(outboundContent string) (string, error) {
+	shareLink, err := shareLinkFromOutbound([]byte(outboundContent))
+	if err != nil {
+		return "", err
+	}
+	return shareLink.Link()
+}
+
+// jsonObject reads decoded JSON of V2Ray configs, such as an outbound or a whole config.
+type jsonObject map[string]any
+
+// field returns the value of the first key found, V2Ray accepts both the protobuf and JSON field names.
+func (o jsonObject) field(keys ...string) any {
+	for _, key := range keys {
+		if value, loaded := o[key]; loaded {
+			return value
+		}
+	}
+	return nil
+}
+
+func (o jsonObject) string(keys ...string) string {
+	return linkString(o.field(keys...))
+}
+
+func (o jsonObject) object(keys ...string) jsonObject {
+	value, _ := o.field(keys...).(map[string]any)
+	return value
+}
+
+// first returns the first object of an array field.
+func (o jsonObject) first(keys ...string) jsonObject {
+	array, _ := o.field(keys...).([]any)
+	if len(array) == 0 {
+		return nil
+	}
+	value, _ := array[0].(map[string]any)
+	return value
+}
+
+func (o jsonObject) strings(keys ...string) []string {
+	array, _ := o.field(keys...).([]any)
+	return common.Map(array, linkString)
+}
+
+func shareLinkFromOutbound(content []byte) (*ShareLink, error) {
+	var outbound jsonObject
+	err := json.Unmarshal(content, &outbound)
+	if err != nil {
+		return nil, E.Cause(err, "parse outbound")
+	}
+	settings := outbound.object("settings")
+	shareLink := &ShareLink{
+		Name:     outbound.string("tag"),
+		Address:  settings.string("address"),
+		UUID:     settings.string("uuid"),
+		Password: settings.string("password"),
+		Method:   settings.string("method"),
+	}
+	port, _ := strconv.ParseUint(settings.string("port"), 10, 16)
+	protocol := outbound.string("protocol")
+	switch protocol {
+	case "vmess", "vless", "trojan", "shadowsocks", "socks":
+		shareLink.Protocol = protocol
+	case "shadowsocks2022":
+		shareLink.Protocol = "shadowsocks"
+		shareLink.Password = settings.string("psk")
+	case "#v2ray.core.proxy.vmess.outbound.Config", "#v2ray.core.proxy.socks.ClientConfig":
+		server := settings.first("Receiver", "receiver", "server")
+		account := server.first("user").object("account")
+		shareLink.Address = server.string("address")
+		port, _ = strconv.ParseUint(server.string("port"), 10, 16)
+		if protocol == "#v2ray.core.proxy.socks.ClientConfig" {
+			shareLink.Protocol = "socks"
+			shareLink.Username = account.string("username")
+			shareLink.Password = account.string("password")
+			break
+		}
+		shareLink.Protocol = "vmess"
+		shareLink.UUID = account.string("id")
+		securityType := account.object("securitySettings", "security_settings").string("type")
+		for method, methodType := range vmessSecurityTypes {
+			if methodType == securityType {
+				shareLink.Method = method
+			}
+		}
+	default:
+		return nil, E.New("unsupported protocol: ", protocol)
+	}
+	shareLink.Port = int32(port)
+	stream := outbound.object("streamSettings")
+	transportSettings := stream.object("transportSettings")
+	shareLink.Transport = stream.string("transport")
+	switch shareLink.Transport {
+	case "ws":
+		shareLink.Path = transportSettings.string("path")
+		headers, _ := transportSettings.field("header").([]any)
+		for _, header := range headers {
+			if header, isObject := header.(map[string]any); isObject && strings.EqualFold(linkString(header["key"]), "Host") {
+				shareLink.Host = linkString(header["value"])
+			}
+		}
+	case "grpc":
+		shareLink.Path = transportSettings.string("serviceName", "service_name")
+	case "h2":
+		shareLink.Path = transportSettings.string("path")
+		shareLink.Host = strings.Join(transportSettings.strings("host"), ",")
+	case "httpupgrade":
+		shareLink.Path = transportSettings.string("path")
+		shareLink.Host = transportSettings.string("host")
+	}
+	if stream.string("security") == "tls" {
+		securitySettings := stream.object("securitySettings")
+		shareLink.TLS = true
+		shareLink.ServerName = securitySettings.string("serverName", "server_name")
+		shareLink.ALPN = strings.Join(securitySettings.strings("nextProtocol", "next_protocol"), ",")
+	}
+	return shareLink, shareLink.check()
+}
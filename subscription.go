@@ -0,0 +1,159 @@
+package libbox
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+	"github.com/sagernet/sing/common/json"
+	"github.com/sagernet/sing/common/json/badjson"
+	"github.com/v2fly/v2ray-core/v5/common/log"
+)
+
+// SubscriptionInfo is reported by remote profile providers in the `subscription-userinfo`
+// and `profile-update-interval` headers, zero values are not provided.
+type SubscriptionInfo struct {
+	Upload   int64
+	Download int64
+	Total    int64
+	// Expire is a unix timestamp in seconds.
+	Expire int64
+	// UpdateInterval is in hours.
+	UpdateInterval int32
+}
+
+func (i *SubscriptionInfo) Used() int64 {
+	return i.Upload + i.Download
+}
+
+// Remaining returns remaining traffic in bytes, or -1 if the total is unknown.
+func (i *SubscriptionInfo) Remaining() int64 {
+	if i.Total <= 0 {
+		return -1
+	}
+	return max(i.Total-i.Used(), 0)
+}
+
+func parseSubscriptionInfo(header http.Header) *SubscriptionInfo {
+	userInfo := header.Get("subscription-userinfo")
+	updateInterval := header.Get("profile-update-interval")
+	if userInfo == "" && updateInterval == "" {
+		return nil
+	}
+	var info SubscriptionInfo
+	for _, field := range strings.Split(userInfo, ";") {
+		key, value, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found {
+			continue
+		}
+		number, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			// some providers send floating numbers
+			floatNumber, floatErr := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if floatErr != nil {
+				continue
+			}
+			number = int64(floatNumber)
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "upload":
+			info.Upload = number
+		case "download":
+			info.Download = number
+		case "total":
+			info.Total = number
+		case "expire":
+			info.Expire = number
+		}
+	}
+	if interval, err := strconv.ParseInt(strings.TrimSpace(updateInterval), 10, 32); err == nil && interval > 0 {
+		info.UpdateInterval = int32(interval)
+	}
+	return &info
+}
+
+// ConvertSubscription converts a subscription body of share links, one per line and optionally
+// base64 encoded, into a V2Ray v5 config based on the template that provides routing and DNS.
+// Servers are inserted before the outbounds of the template, so the first one is the default.
+func ConvertSubscription(content string, template string) (*StringBox, error) {
+	if decoded, err := decodeBase64String(strings.Join(strings.Fields(content), "")); err == nil {
+		content = string(decoded)
+	}
+	if strings.TrimSpace(template) == "" {
+		template = "{}"
+	}
+	// the template is a config, which may have comments
+	config, err := json.UnmarshalExtended[badjson.JSONObject]([]byte(template))
+	if err != nil {
+		return nil, E.Cause(err, "parse template")
+	}
+	var templateOutbounds badjson.JSONArray
+	if rawOutbounds, loaded := config.Get("outbounds"); loaded {
+		var isArray bool
+		templateOutbounds, isArray = rawOutbounds.(badjson.JSONArray)
+		if !isArray {
+			return nil, E.New("parse template: outbounds is not an array")
+		}
+	}
+	var (
+		outbounds []any
+		tags      = make(map[string]bool)
+	)
+	// servers must not reuse tags of the template outbounds, which routing rules refer to
+	for _, rawOutbound := range templateOutbounds {
+		if outbound, isObject := rawOutbound.(*badjson.JSONObject); isObject {
+			if tag, loaded := outbound.Get("tag"); loaded {
+				if tagString, isString := tag.(string); isString {
+					tags[tagString] = true
+				}
+			}
+		}
+	}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		shareLink, err := parseShareLink(line)
+		if err != nil {
+			log.Record(&log.GeneralMessage{
+				Severity: log.Severity_Warning,
+				Content:  F.ToString("skip share link: ", err),
+			})
+			continue
+		}
+		tag := shareLink.Name
+		if tag == "" {
+			tag = F.ToString(shareLink.Protocol, "-", len(outbounds)+1)
+		}
+		baseTag := tag
+		for i := 2; tags[tag]; i++ {
+			tag = F.ToString(baseTag, " (", i, ")")
+		}
+		tags[tag] = true
+		outbound, err := shareLink.outbound(tag)
+		if err != nil {
+			return nil, err
+		}
+		outbounds = append(outbounds, outbound)
+	}
+	if len(outbounds) == 0 {
+		return nil, E.New("no supported servers found in subscription")
+	}
+	outbounds = append(outbounds, templateOutbounds...)
+	config.Put("outbounds", badjson.JSONArray(outbounds))
+	configContent, err := stdjson.Marshal(&config)
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	err = stdjson.Indent(&buffer, configContent, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return wrapString(buffer.String()), nil
+}
@@ -1,7 +1,6 @@
 package libbox
 
 import (
-	"bytes"
 	"context"
 	"net"
 	"net/netip"
@@ -9,6 +8,8 @@ import (
 	"time"
 	_ "unsafe"
 
+	"github.com/nekohasekai/libwtf/internal/conntrack"
+
 	"github.com/sagernet/sing-tun"
 	"github.com/sagernet/sing-vmess/packetaddr"
 	"github.com/sagernet/sing/common"
@@ -25,6 +26,7 @@ import (
 	"github.com/v2fly/v2ray-core/v5/common/log"
 	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
 	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
 	"github.com/v2fly/v2ray-core/v5/features/routing"
 )
 
@@ -32,21 +34,30 @@ type tun2ray struct {
 	ctx        context.Context
 	instance   *core.Instance
 	dispatcher routing.Dispatcher
+	dnsClient  dns.Client
+	router     routing.Router
 	iif        PlatformInterface
 	network    *networkManager
+	options    tunConfig
+	sniffing   session.SniffingRequest
 	tunOptions tun.Options
 	dnsServer  netip.Addr
 	tun        tun.Tun
 	stack      tun.Stack
 }
 
-func newTun2ray(ctx context.Context, instance *core.Instance, iif PlatformInterface) *tun2ray {
+func newTun2ray(ctx context.Context, instance *core.Instance, iif PlatformInterface, options tunConfig, networkOptions networkConfig) *tun2ray {
+	dnsClient := instance.GetFeature(dns.ClientType()).(dns.Client)
 	return &tun2ray{
 		ctx:        ctx,
 		instance:   instance,
 		dispatcher: instance.GetFeature(routing.DispatcherType()).(routing.Dispatcher),
+		dnsClient:  dnsClient,
+		router:     instance.GetFeature(routing.RouterType()).(routing.Router),
 		iif:        iif,
-		network:    newNetworkManager(iif),
+		network:    newNetworkManager(iif, dnsClient, networkOptions),
+		options:    options,
+		sniffing:   common.Must1(options.Sniffing.build()),
 		tunOptions: tun.Options{
 			Inet4Address: []netip.Prefix{
 				netip.MustParsePrefix("172.19.0.1/30"),
@@ -69,6 +80,9 @@ func (t *tun2ray) Start() error {
 	if err != nil {
 		return err
 	}
+	if len(t.tunOptions.DNSServers) > 0 {
+		t.dnsServer = t.tunOptions.DNSServers[0]
+	}
 	routeRanges, err := t.tunOptions.BuildAutoRouteRanges(true)
 	if err != nil {
 		return err
@@ -138,26 +152,61 @@ func (t *tun2ray) NewConnectionEx(ctx context.Context, conn net.Conn, source M.S
 		Severity: log.Severity_Info,
 		Content:  F.ToString("inbound connection from ", source, " to ", destination),
 	})
+	if t.isEncryptedDNS(destination) {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Info,
+			Content:  F.ToString("rejected encrypted dns connection from ", source, " to ", destination),
+		})
+		conn.Close()
+		return
+	}
+	isDNS := t.isDNS(destination)
+	if isDNS && t.options.DNSResponder {
+		t.newDNSConnection(conn, source)
+		return
+	}
 	inbound := &session.Inbound{
 		Source: tcpDestination(source.AddrPort()),
-		Tag:    "injectedTun",
+		Tag:    t.inboundTag(N.NetworkTCP, destination, isDNS),
 	}
-	ctx = toContext(ctx, t.instance)
-	ctx = session.ContextWithInbound(ctx, inbound)
-	isDNS := destination.Port == 53
+	content := new(session.Content)
 	if isDNS {
-		ctx = session.ContextWithContent(ctx, &session.Content{
-			Protocol: "dns",
-		})
+		content.Protocol = "dns"
 	} else {
-		ctx = session.ContextWithContent(ctx, &session.Content{
-			SniffingRequest: session.SniffingRequest{
-				Enabled: true,
-			},
+		content.SniffingRequest = t.sniffing
+	}
+	owner := t.attachConnectionOwner(inbound, content, N.NetworkTCP, source, destination)
+	// sessions are checked against the memory limit like outbound connections,
+	// so that the OOM killer also fires when memory grows from inbound flows.
+	err := conntrack.KillerCheck()
+	if err != nil {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Warning,
+			Content:  F.ToString("drop connection to ", destination, ": ", err),
 		})
+		conn.Close()
+		return
 	}
-	link, err := t.dispatcher.Dispatch(ctx, tcpDestination(destination.AddrPort()))
+	// tracked so that conntrack.Close resets the flow on default interface changes
+	defer conntrack.Track(newTrackedConnection(conn, N.NetworkTCP, source, destination, inbound.Tag, owner)).Untrack()
+	t.attachNetworkState(content)
+	ctx = toContext(ctx, t.instance)
+	ctx = session.ContextWithInbound(ctx, inbound)
+	ctx = session.ContextWithContent(ctx, content)
+	vDest := tcpDestination(destination.AddrPort())
+	var cached v2rayBuf.MultiBuffer
+	if content.SniffingRequest.Enabled && t.sniffInPlace() {
+		cached, err = t.readSniffPayload(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		ctx, vDest = t.sniff(ctx, content, vDest, cached)
+	}
+	ctx = t.applyNetworkPolicy(ctx, isDNS)
+	link, err := t.dispatcher.Dispatch(ctx, vDest)
 	if err != nil {
+		v2rayBuf.ReleaseMulti(cached)
 		log.Record(&log.GeneralMessage{
 			Severity: log.Severity_Error,
 			Content:  F.ToString("process connection from ", source, " to ", destination, ": ", err),
@@ -166,6 +215,12 @@ func (t *tun2ray) NewConnectionEx(ctx context.Context, conn net.Conn, source M.S
 	}
 	var group task.Group
 	group.Append("upload", func(ctx context.Context) error {
+		if cached != nil {
+			err := link.Writer.WriteMultiBuffer(cached)
+			if err != nil {
+				return err
+			}
+		}
 		return v2rayBuf.Copy(v2rayBuf.NewReader(conn), link.Writer)
 	})
 	group.Append("download", func(ctx context.Context) error {
@@ -185,48 +240,106 @@ func (t *tun2ray) NewPacketConnectionEx(ctx context.Context, conn N.PacketConn,
 		Severity: log.Severity_Info,
 		Content:  F.ToString("inbound packet connection from ", source, " to ", destination),
 	})
+	if t.isEncryptedDNS(destination) {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Info,
+			Content:  F.ToString("rejected encrypted dns packet connection from ", source, " to ", destination),
+		})
+		conn.Close()
+		return
+	}
+	isDNS := t.isDNS(destination)
+	if t.options.DNSResponder {
+		dnsConn := &dnsResponderPacketConn{Conn: conn.(udpnat.Conn), t: t, source: source}
+		conn = dnsConn
+		if isDNS {
+			var err error
+			destination, err = dnsConn.waitPacket()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			isDNS = false
+		}
+	}
+	if policy := t.network.policy(); policy != nil && policy.BlockAllUDP && !isDNS {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Info,
+			Content:  F.ToString("blocked packet connection from ", source, " to ", destination, " by network policy"),
+		})
+		conn.Close()
+		return
+	}
 	inbound := &session.Inbound{
 		Source: udpDestination(source.AddrPort()),
-		Tag:    "injectedTun",
+		Tag:    t.inboundTag(N.NetworkUDP, destination, isDNS),
 	}
-	ctx = toContext(ctx, t.instance)
-	ctx = session.ContextWithInbound(ctx, inbound)
-	isDNS := destination.Port == 53
+	packetAddr := t.options.PacketAddr && !isDNS && destination.Port != 443
+	content := new(session.Content)
 	if isDNS {
-		ctx = session.ContextWithContent(ctx, &session.Content{
-			Protocol: "dns",
-		})
-	} else {
-		ctx = session.ContextWithContent(ctx, &session.Content{
-			SniffingRequest: session.SniffingRequest{
-				Enabled: true,
-			},
+		content.Protocol = "dns"
+	} else if !packetAddr {
+		content.SniffingRequest = t.sniffing
+	}
+	owner := t.attachConnectionOwner(inbound, content, N.NetworkUDP, source, destination)
+	// sessions are checked against the memory limit like outbound connections,
+	// so that the OOM killer also fires when memory grows from inbound flows.
+	err := conntrack.KillerCheck()
+	if err != nil {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Warning,
+			Content:  F.ToString("drop packet connection to ", destination, ": ", err),
 		})
+		conn.Close()
+		return
 	}
+	defer conntrack.Track(newTrackedConnection(conn, N.NetworkUDP, source, destination, inbound.Tag, owner)).Untrack()
+	t.attachNetworkState(content)
+	ctx = toContext(ctx, t.instance)
+	ctx = session.ContextWithInbound(ctx, inbound)
+	ctx = session.ContextWithContent(ctx, content)
 	var vDest v2rayNet.Destination
-	//if !isDNS {
-	//	vDest = v2rayNet.Destination{
-	//		Address: v2rayNet.DomainAddress(packetaddr.SeqPacketMagicAddress),
-	//		Network: v2rayNet.Network_UDP,
-	//	}
-	//} else {
-	vDest = udpDestination(destination.AddrPort())
-	//}
+	if packetAddr {
+		vDest = v2rayNet.Destination{
+			Address: v2rayNet.DomainAddress(packetaddr.SeqPacketMagicAddress),
+			Network: v2rayNet.Network_UDP,
+		}
+	} else {
+		vDest = udpDestination(destination.AddrPort())
+	}
+	packetConn := &v2rayPacketConn{
+		conn:        conn.(udpnat.Conn),
+		destination: destination,
+		packetAddr:  packetAddr,
+	}
+	var cached v2rayBuf.MultiBuffer
+	if content.SniffingRequest.Enabled && t.sniffInPlace() {
+		var err error
+		cached, err = packetConn.ReadMultiBuffer()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		ctx, vDest = t.sniff(ctx, content, vDest, cached)
+	}
+	ctx = t.applyNetworkPolicy(ctx, isDNS)
 	link, err := t.dispatcher.Dispatch(ctx, vDest)
 	if err != nil {
+		v2rayBuf.ReleaseMulti(cached)
 		log.Record(&log.GeneralMessage{
 			Severity: log.Severity_Error,
 			Content:  F.ToString("process packet connection from ", source, " to ", destination, ": ", err),
 		})
 		return
 	}
-	packetConn := &v2rayPacketConn{
-		conn:        conn.(udpnat.Conn),
-		destination: destination,
-		// packetAddr:  !isDNS && destination.Port != 443,
-	}
 	var group task.Group
 	group.Append("upload", func(ctx context.Context) error {
+		if cached != nil {
+			err := link.Writer.WriteMultiBuffer(cached)
+			if err != nil {
+				return err
+			}
+		}
 		return v2rayBuf.Copy(packetConn, link.Writer)
 	})
 	group.Append("download", func(ctx context.Context) error {
@@ -241,6 +354,49 @@ func (t *tun2ray) NewPacketConnectionEx(ctx context.Context, conn N.PacketConn,
 	_ = group.Run(ctx)
 }
 
+// attachNetworkState sets the `expensive`, `constrained` and `ssid` content attributes,
+// so that attribute routing rules can match on the state of the default interface.
+func (t *tun2ray) attachNetworkState(content *session.Content) {
+	isExpensive, isConstrained := t.network.networkState()
+	if isExpensive {
+		content.SetAttribute("expensive", "true")
+	}
+	if isConstrained {
+		content.SetAttribute("constrained", "true")
+	}
+	if ssid := t.network.wifiSSID(); ssid != "" {
+		content.SetAttribute("ssid", ssid)
+	}
+}
+
+func (t *tun2ray) applyNetworkPolicy(ctx context.Context, isDNS bool) context.Context {
+	policy := t.network.policy()
+	if policy == nil || policy.OutboundTag == "" || isDNS {
+		return ctx
+	}
+	return session.SetForcedOutboundTagToContext(ctx, policy.OutboundTag)
+}
+
+func (t *tun2ray) inboundTag(network string, destination M.Socksaddr, isDNS bool) string {
+	tag := t.options.InboundTag
+	if tag == "" {
+		tag = "injectedTun"
+	}
+	if !t.options.SplitInbound {
+		return tag
+	}
+	switch {
+	case isDNS:
+		return tag + "-dns"
+	case network == N.NetworkUDP:
+		return tag + "-udp"
+	case destination.IsIPv6():
+		return tag + "-tcp6"
+	default:
+		return tag + "-tcp4"
+	}
+}
+
 func (t *tun2ray) Close() {
 	common.Close(t.stack, t.tun)
 }
@@ -259,7 +415,7 @@ func (r *v2rayPacketConn) ReadMultiBuffer() (v2rayBuf.MultiBuffer, error) {
 	vBuf := v2rayBuf.New()
 	buffer := buf.With(vBuf.Extend(v2rayBuf.Size))
 	if r.packetAddr {
-		buffer.Advance(packetAddrMaxLen)
+		buffer.Resize(packetAddrMaxLen, 0)
 	}
 	destination, err := r.conn.ReadPacket(buffer)
 	if err != nil {
@@ -267,7 +423,8 @@ func (r *v2rayPacketConn) ReadMultiBuffer() (v2rayBuf.MultiBuffer, error) {
 		return nil, err
 	}
 	if r.packetAddr {
-		err = packetaddr.AddressSerializer.WriteAddrPort(bytes.NewBuffer(buffer.Extend(packetaddr.AddressSerializer.AddrPortLen(destination))), destination)
+		destination = destination.Unwrap()
+		err = packetaddr.AddressSerializer.WriteAddrPort(buf.With(buffer.ExtendHeader(packetaddr.AddressSerializer.AddrPortLen(destination))), destination)
 		if err != nil {
 			vBuf.Release()
 			return nil, err
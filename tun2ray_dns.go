@@ -0,0 +1,204 @@
+package libbox
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+	M "github.com/sagernet/sing/common/metadata"
+	udpnat "github.com/sagernet/sing/common/udpnat2"
+	"github.com/v2fly/v2ray-core/v5/common/log"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsHijackPort = "port"
+	dnsHijackTUN  = "tun"
+	dnsHijackNone = "none"
+)
+
+// dnsResponseTTL is short because the V2Ray DNS client does not expose the record TTL,
+// repeated queries are answered from its cache, which follows the upstream TTL.
+const dnsResponseTTL = 10
+
+func (t *tun2ray) isDNS(destination M.Socksaddr) bool {
+	return destination.Port == 53 && t.isHijackedDNSServer(destination)
+}
+
+// isEncryptedDNS reports DNS over TLS or QUIC to a hijacked server, which can not be answered,
+// so it is rejected to make the resolver fall back to plain DNS.
+func (t *tun2ray) isEncryptedDNS(destination M.Socksaddr) bool {
+	return destination.Port == 853 && t.isHijackedDNSServer(destination)
+}
+
+func (t *tun2ray) isHijackedDNSServer(destination M.Socksaddr) bool {
+	switch t.options.DNSHijack {
+	case dnsHijackNone:
+		return false
+	case dnsHijackTUN:
+		return destination.Addr.Unmap() == t.dnsServer
+	default:
+		return true
+	}
+}
+
+func (t *tun2ray) newDNSConnection(conn net.Conn, source M.Socksaddr) {
+	defer conn.Close()
+	for {
+		var queryLength uint16
+		err := binary.Read(conn, binary.BigEndian, &queryLength)
+		if err != nil {
+			return
+		}
+		query := make([]byte, queryLength)
+		_, err = io.ReadFull(conn, query)
+		if err != nil {
+			return
+		}
+		response, err := t.exchangeDNS(query)
+		if err != nil {
+			log.Record(&log.GeneralMessage{
+				Severity: log.Severity_Error,
+				Content:  F.ToString("process dns query from ", source, ": ", err),
+			})
+			return
+		}
+		err = binary.Write(conn, binary.BigEndian, uint16(len(response)))
+		if err != nil {
+			return
+		}
+		_, err = conn.Write(response)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dnsResponderPacketConn answers DNS queries in process and returns other packets.
+// UDP flows are keyed by the source only, so each packet is checked by its own destination.
+type dnsResponderPacketConn struct {
+	udpnat.Conn
+	t             *tun2ray
+	source        M.Socksaddr
+	pending       []byte
+	pendingTarget M.Socksaddr
+}
+
+// waitPacket answers queries until a packet to another destination arrives, which is returned
+// by the next ReadPacket, and returns its destination.
+func (c *dnsResponderPacketConn) waitPacket() (M.Socksaddr, error) {
+	buffer := buf.NewPacket()
+	defer buffer.Release()
+	destination, err := c.ReadPacket(buffer)
+	if err != nil {
+		return M.Socksaddr{}, err
+	}
+	c.pending = append([]byte(nil), buffer.Bytes()...)
+	c.pendingTarget = destination
+	return destination, nil
+}
+
+func (c *dnsResponderPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	if c.pending != nil {
+		_, err := buffer.Write(c.pending)
+		c.pending = nil
+		return c.pendingTarget, err
+	}
+	start := buffer.Start()
+	for {
+		destination, err := c.Conn.ReadPacket(buffer)
+		if err != nil {
+			return M.Socksaddr{}, err
+		}
+		if !c.t.isDNS(destination) {
+			return destination, nil
+		}
+		response, err := c.t.exchangeDNS(buffer.Bytes())
+		buffer.Resize(start, 0)
+		if err != nil {
+			log.Record(&log.GeneralMessage{
+				Severity: log.Severity_Error,
+				Content:  F.ToString("process dns query from ", c.source, ": ", err),
+			})
+			continue
+		}
+		err = c.Conn.WritePacket(buf.As(response), destination)
+		if err != nil {
+			return M.Socksaddr{}, err
+		}
+	}
+}
+
+// exchangeDNS answers A and AAAA queries from the V2Ray DNS client,
+// other query types are answered with an empty response.
+func (t *tun2ray) exchangeDNS(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, E.Cause(err, "parse dns query")
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, E.Cause(err, "parse dns question")
+	}
+	domain := question.Name.String()
+	var (
+		ips    []net.IP
+		rCode  = dnsmessage.RCodeSuccess
+		option dns.IPOption
+	)
+	switch question.Type {
+	case dnsmessage.TypeA:
+		option = dns.IPOption{IPv4Enable: true, FakeEnable: true}
+	case dnsmessage.TypeAAAA:
+		option = dns.IPOption{IPv6Enable: true, FakeEnable: true}
+	}
+	if option.IsValid() {
+		ips, err = dns.LookupIPWithOption(t.dnsClient, domain, option)
+		if err != nil && err != dns.ErrEmptyResponse {
+			if code := dns.RCodeFromError(err); code != 0 {
+				rCode = dnsmessage.RCode(code)
+			} else {
+				rCode = dnsmessage.RCodeServerFailure
+			}
+			log.Record(&log.GeneralMessage{
+				Severity: log.Severity_Warning,
+				Content:  F.ToString("lookup ", domain, ": ", err),
+			})
+		}
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rCode,
+	})
+	builder.EnableCompression()
+	common.Must(builder.StartQuestions())
+	common.Must(builder.Question(question))
+	common.Must(builder.StartAnswers())
+	answerHeader := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Class: dnsmessage.ClassINET,
+		TTL:   dnsResponseTTL,
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+			var resource dnsmessage.AResource
+			copy(resource.A[:], ip4)
+			common.Must(builder.AResource(answerHeader, resource))
+		} else if len(ip) == net.IPv6len && question.Type == dnsmessage.TypeAAAA {
+			var resource dnsmessage.AAAAResource
+			copy(resource.AAAA[:], ip)
+			common.Must(builder.AAAAResource(answerHeader, resource))
+		}
+	}
+	return builder.Finish()
+}
@@ -0,0 +1,163 @@
+package libbox
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	udpnat "github.com/sagernet/sing/common/udpnat2"
+	"github.com/v2fly/v2ray-core/v5/features/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type fakeDNSClient struct {
+	dns.Client
+}
+
+func (c *fakeDNSClient) LookupIPv4(domain string) ([]net.IP, error) {
+	return []net.IP{net.IPv4(1, 2, 3, 4)}, nil
+}
+
+type queuedPacket struct {
+	payload     []byte
+	destination M.Socksaddr
+}
+
+type queuedNATConn struct {
+	udpnat.Conn
+	packets []queuedPacket
+	written []queuedPacket
+}
+
+func (c *queuedNATConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	if len(c.packets) == 0 {
+		return M.Socksaddr{}, io.EOF
+	}
+	packet := c.packets[0]
+	c.packets = c.packets[1:]
+	_, err := buffer.Write(packet.payload)
+	return packet.destination, err
+}
+
+func (c *queuedNATConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	defer buffer.Release()
+	c.written = append(c.written, queuedPacket{append([]byte(nil), buffer.Bytes()...), destination})
+	return nil
+}
+
+func newDNSQuery(t *testing.T, id uint16) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	err := builder.StartQuestions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = builder.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("example.com."),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func TestIsDNS(t *testing.T) {
+	for _, testCase := range []struct {
+		hijack       string
+		destination  string
+		dns          bool
+		encryptedDNS bool
+	}{
+		{"", "8.8.8.8:53", true, false},
+		{"", "8.8.8.8:853", false, true},
+		{"", "8.8.8.8:443", false, false},
+		{dnsHijackTUN, "1.1.1.1:53", true, false},
+		{dnsHijackTUN, "1.1.1.1:853", false, true},
+		{dnsHijackTUN, "8.8.8.8:53", false, false},
+		{dnsHijackTUN, "8.8.8.8:853", false, false},
+		{dnsHijackNone, "8.8.8.8:53", false, false},
+		{dnsHijackNone, "8.8.8.8:853", false, false},
+	} {
+		tun := &tun2ray{options: tunConfig{DNSHijack: testCase.hijack}}
+		tun.dnsServer = M.ParseSocksaddr("1.1.1.1:53").Addr
+		destination := M.ParseSocksaddr(testCase.destination)
+		if isDNS := tun.isDNS(destination); isDNS != testCase.dns {
+			t.Errorf("%q %s: isDNS = %v", testCase.hijack, destination, isDNS)
+		}
+		if isEncryptedDNS := tun.isEncryptedDNS(destination); isEncryptedDNS != testCase.encryptedDNS {
+			t.Errorf("%q %s: isEncryptedDNS = %v", testCase.hijack, destination, isEncryptedDNS)
+		}
+	}
+}
+
+func TestDNSResponderPacketConn(t *testing.T) {
+	dnsServer := M.ParseSocksaddr("8.8.8.8:53")
+	otherServer := M.ParseSocksaddr("9.9.9.9:443")
+	conn := &queuedNATConn{packets: []queuedPacket{
+		{newDNSQuery(t, 1), dnsServer},
+		{[]byte("first"), otherServer},
+		{newDNSQuery(t, 2), dnsServer},
+		{[]byte("second"), otherServer},
+	}}
+	tun := &tun2ray{dnsClient: &fakeDNSClient{}}
+	dnsConn := &dnsResponderPacketConn{Conn: conn, t: tun}
+	destination, err := dnsConn.waitPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if destination != otherServer {
+		t.Fatalf("waitPacket: expected %s, got %s", otherServer, destination)
+	}
+	for _, expected := range []string{"first", "second"} {
+		buffer := buf.NewPacket()
+		destination, err = dnsConn.ReadPacket(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if destination != otherServer || string(buffer.Bytes()) != expected {
+			t.Fatalf("read: expected %q to %s, got %q to %s", expected, otherServer, buffer.Bytes(), destination)
+		}
+		buffer.Release()
+	}
+	if len(conn.written) != 2 {
+		t.Fatalf("expected 2 dns responses, got %d", len(conn.written))
+	}
+	for i, response := range conn.written {
+		if response.destination != dnsServer {
+			t.Fatalf("response %d: sent from %s", i, response.destination)
+		}
+		var parser dnsmessage.Parser
+		header, err := parser.Start(response.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.ID != uint16(i+1) || !header.Response {
+			t.Fatalf("response %d: unexpected header %+v", i, header)
+		}
+		err = parser.SkipAllQuestions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		answerHeader, err := parser.AnswerHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answerHeader.TTL != dnsResponseTTL {
+			t.Fatalf("response %d: unexpected ttl %d", i, answerHeader.TTL)
+		}
+		answer, err := parser.AResource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answer.A != [4]byte{1, 2, 3, 4} {
+			t.Fatalf("response %d: unexpected answer %v", i, answer.A)
+		}
+	}
+}
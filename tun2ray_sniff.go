@@ -0,0 +1,139 @@
+package libbox
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	F "github.com/sagernet/sing/common/format"
+	"github.com/v2fly/v2ray-core/v5/app/dispatcher"
+	v2rayCommon "github.com/v2fly/v2ray-core/v5/common"
+	v2rayBuf "github.com/v2fly/v2ray-core/v5/common/buf"
+	"github.com/v2fly/v2ray-core/v5/common/log"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/common/strmatcher"
+	"github.com/v2fly/v2ray-core/v5/features/outbound"
+	routingSession "github.com/v2fly/v2ray-core/v5/features/routing/session"
+)
+
+const sniffTimeout = 300 * time.Millisecond
+
+// sniffInPlace reports whether sniffing should be done by tun2ray before dispatching,
+// which is required for options that the V2Ray dispatcher does not support.
+func (t *tun2ray) sniffInPlace() bool {
+	options := t.options.Sniffing
+	return options != nil && (options.RouteOnly || len(options.DomainsExcluded) > 0)
+}
+
+// readSniffPayload reads the first packet of the connection, waiting up to sniffTimeout for protocols
+// where the server speaks first. Errors other than the timeout are returned, unless data was read.
+func (t *tun2ray) readSniffPayload(conn net.Conn) (v2rayBuf.MultiBuffer, error) {
+	if t.sniffing.MetadataOnly {
+		return nil, nil
+	}
+	payload := v2rayBuf.New()
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	_, err := payload.ReadFrom(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if payload.IsEmpty() {
+		payload.Release()
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return v2rayBuf.MultiBuffer{payload}, nil
+}
+
+// sniff applies the sniffing request to the cached payload, and returns the context and
+// destination to dispatch with.
+func (t *tun2ray) sniff(ctx context.Context, content *session.Content, destination v2rayNet.Destination, payload v2rayBuf.MultiBuffer) (context.Context, v2rayNet.Destination) {
+	content.SniffingRequest = session.SniffingRequest{}
+	sniffCtx := session.ContextWithOutbound(ctx, &session.Outbound{Target: destination})
+	sniffer := dispatcher.NewSniffer(sniffCtx)
+	result, err := sniffer.SniffMetadata(sniffCtx)
+	if !t.sniffing.MetadataOnly && !payload.IsEmpty() {
+		contentResult, contentErr := sniffer.Sniff(sniffCtx, payload[0].Bytes(), destination.Network)
+		if contentErr == nil && err == nil {
+			result = dispatcher.CompositeResult(result, contentResult)
+		} else if contentErr == nil || err != nil {
+			result, err = contentResult, contentErr
+		}
+	}
+	if err != nil {
+		return ctx, destination
+	}
+	content.Protocol = result.Protocol()
+	if !shouldOverrideDestination(result, t.sniffing.OverrideDestinationForProtocol) {
+		return ctx, destination
+	}
+	domain, err := strmatcher.ToDomain(result.Domain())
+	if err != nil || t.isSniffDomainExcluded(domain) {
+		return ctx, destination
+	}
+	sniffedDestination := destination
+	sniffedDestination.Address = v2rayNet.ParseAddress(domain)
+	if !t.options.Sniffing.RouteOnly {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Info,
+			Content:  F.ToString("sniffed domain ", domain, " for ", destination),
+		})
+		return ctx, sniffedDestination
+	}
+	// the sniffed domain decides the outbound, also when no rule matches, so that IP rules do not apply
+	var outboundTag string
+	route, err := t.router.PickRoute(routingSession.AsRoutingContext(session.ContextWithOutbound(ctx, &session.Outbound{Target: sniffedDestination})))
+	if err == nil {
+		outboundTag = route.GetOutboundTag()
+	} else if err == v2rayCommon.ErrNoClue {
+		outboundManager := t.instance.GetFeature(outbound.ManagerType()).(outbound.Manager)
+		if handler := outboundManager.GetDefaultHandler(); handler != nil {
+			outboundTag = handler.Tag()
+		}
+	} else {
+		log.Record(&log.GeneralMessage{
+			Severity: log.Severity_Warning,
+			Content:  F.ToString("route sniffed domain ", domain, " for ", destination, ": ", err),
+		})
+	}
+	if outboundTag == "" {
+		return ctx, destination
+	}
+	log.Record(&log.GeneralMessage{
+		Severity: log.Severity_Info,
+		Content:  F.ToString("sniffed domain ", domain, " for ", destination, ", routed to ", outboundTag),
+	})
+	return session.SetForcedOutboundTagToContext(ctx, outboundTag), destination
+}
+
+func (t *tun2ray) isSniffDomainExcluded(domain string) bool {
+	for _, excluded := range t.options.Sniffing.DomainsExcluded {
+		if domain == excluded || strings.HasSuffix(domain, "."+excluded) {
+			return true
+		}
+	}
+	return false
+}
+
+func shouldOverrideDestination(result dispatcher.SniffResult, protocols []string) bool {
+	if result.Domain() == "" {
+		return false
+	}
+	protocol := result.Protocol()
+	if composite, ok := result.(dispatcher.SnifferResultComposite); ok {
+		protocol = composite.ProtocolForDomainResult()
+	}
+	for _, p := range protocols {
+		if strings.HasPrefix(protocol, p) || strings.HasSuffix(protocol, p) {
+			return true
+		}
+		if subset, ok := result.(dispatcher.SnifferIsProtoSubsetOf); ok && subset.IsProtoSubsetOf(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package libbox
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5"
+	v2rayBuf "github.com/v2fly/v2ray-core/v5/common/buf"
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/features/routing"
+)
+
+func TestSniffRouteOnly(t *testing.T) {
+	_, config, err := parseConfig(`{
+	"outbounds": [
+		{"protocol": "freedom", "tag": "direct"},
+		{"protocol": "blackhole", "tag": "proxy"},
+		{"protocol": "freedom", "tag": "ip"}
+	],
+	"routing": {"rules": [
+		{"type": "field", "domain": ["domain:example.com"], "outboundTag": "proxy"},
+		{"type": "field", "ip": ["1.2.3.4/32"], "outboundTag": "ip"}
+	]}
+}`, ConfigFormatV4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := core.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := tunConfig{Sniffing: &tunSniffingConfig{Enabled: true, DestOverride: []string{"http"}, RouteOnly: true}}
+	tun := &tun2ray{
+		instance: instance,
+		router:   instance.GetFeature(routing.RouterType()).(routing.Router),
+		options:  options,
+	}
+	tun.sniffing, err = options.Sniffing.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := v2rayNet.TCPDestination(v2rayNet.ParseAddress("1.2.3.4"), 80)
+	for _, testCase := range []struct {
+		host     string
+		expected string
+	}{
+		{"www.example.com", "proxy"},
+		// the sniffed domain matches no rule, so the IP rule must not apply
+		{"other.org", "direct"},
+	} {
+		payload := v2rayBuf.New()
+		payload.WriteString("GET / HTTP/1.1\r\nHost: " + testCase.host + "\r\n\r\n")
+		content := new(session.Content)
+		ctx := toContext(context.Background(), instance)
+		ctx = session.ContextWithContent(ctx, content)
+		ctx, sniffedDestination := tun.sniff(ctx, content, destination, v2rayBuf.MultiBuffer{payload})
+		payload.Release()
+		if sniffedDestination != destination {
+			t.Fatalf("%s: destination changed to %s", testCase.host, sniffedDestination)
+		}
+		if outboundTag := session.GetForcedOutboundTagFromContext(ctx); outboundTag != testCase.expected {
+			t.Fatalf("%s: expected outbound %s, got %q", testCase.host, testCase.expected, outboundTag)
+		}
+	}
+}
+
+func TestReadSniffPayload(t *testing.T) {
+	tun := new(tun2ray)
+	client, server := net.Pipe()
+	go client.Write([]byte("hello"))
+	payload, err := tun.readSniffPayload(server)
+	if err != nil || payload.String() != "hello" {
+		t.Fatalf("read: %q, %v", payload.String(), err)
+	}
+	v2rayBuf.ReleaseMulti(payload)
+	payload, err = tun.readSniffPayload(server)
+	if err != nil || payload != nil {
+		t.Fatalf("timeout: %v, %v", payload, err)
+	}
+	client.Close()
+	_, err = tun.readSniffPayload(server)
+	if err == nil {
+		t.Fatal("expected error after close")
+	}
+}
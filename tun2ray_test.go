@@ -0,0 +1,83 @@
+package libbox
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/udpnat2"
+)
+
+type fakeNATConn struct {
+	udpnat.Conn
+	source      M.Socksaddr
+	payload     []byte
+	written     []byte
+	destination M.Socksaddr
+}
+
+func (c *fakeNATConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	_, err := buffer.Write(c.payload)
+	return c.source, err
+}
+
+func (c *fakeNATConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	defer buffer.Release()
+	c.written = append([]byte(nil), buffer.Bytes()...)
+	c.destination = destination
+	return nil
+}
+
+func TestV2RayPacketConnPacketAddr(t *testing.T) {
+	payload := []byte("hello")
+	for _, testCase := range []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"IPv4", "1.2.3.4:53", "1.2.3.4:53"},
+		{"IPv6", "[2001:db8::1]:443", "[2001:db8::1]:443"},
+		{"IPv4-mapped", "[::ffff:1.2.3.4]:53", "1.2.3.4:53"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			conn := &fakeNATConn{source: M.ParseSocksaddr(testCase.source), payload: payload}
+			packetConn := &v2rayPacketConn{conn: conn, packetAddr: true}
+			mb, err := packetConn.ReadMultiBuffer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = packetConn.WriteMultiBuffer(mb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(conn.written, payload) {
+				t.Fatalf("payload: expected %q, got %q", payload, conn.written)
+			}
+			if conn.destination.String() != testCase.expected {
+				t.Fatalf("destination: expected %s, got %s", testCase.expected, conn.destination)
+			}
+		})
+	}
+}
+
+func TestV2RayPacketConnFixedDestination(t *testing.T) {
+	payload := []byte("hello")
+	destination := M.ParseSocksaddr("8.8.8.8:53")
+	conn := &fakeNATConn{source: M.ParseSocksaddr("1.2.3.4:53"), payload: payload}
+	packetConn := &v2rayPacketConn{conn: conn, destination: destination}
+	mb, err := packetConn.ReadMultiBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mb[0].Bytes(), payload) {
+		t.Fatalf("read: expected %q, got %q", payload, mb[0].Bytes())
+	}
+	err = packetConn.WriteMultiBuffer(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(conn.written, payload) || conn.destination != destination {
+		t.Fatalf("write: got %q to %s", conn.written, conn.destination)
+	}
+}